@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Files with more than one audio track get alternate audio renditions. The
+// first track stays muxed in the video segments, so nothing changes for
+// them (remux, optimized package); every other track is encoded alone, with
+// the same segment boundaries, and the player switches between them.
+
+// audioSignature describes the encode of the audio-only segments.
+var audioSignature = fmt.Sprintf("aac bitrate=%dk ch=2 ar=48000", audioBitrateKbps)
+
+// audioRendition is the namespace of a track, on disk and in the queue.
+func audioRendition(track int) string {
+	return fmt.Sprintf("audio_%d", track)
+}
+
+func audioSegmentFile(id string, track, segNum int) string {
+	return filepath.Join(segmentsDir, id, audioRendition(track), fmt.Sprintf("segment_%d.ts", segNum))
+}
+
+// findAudioTrack returns the alternate audio track with the given index, or nil.
+// The first track has no rendition of its own.
+func findAudioTrack(video *VideoData, param string) *AudioTrack {
+	n, err := strconv.Atoi(param)
+	if err != nil || n <= 0 || len(video.AudioTracks) < 2 {
+		return nil
+	}
+	for _, t := range video.AudioTracks {
+		if t.Index == n {
+			return &t
+		}
+	}
+	return nil
+}
+
+// audioMedia writes the #EXT-X-MEDIA entries of the audio tracks, in the
+// "audio" group; empty when the file has a single track. The first track has
+// no URI: it is the one inside the video segments.
+func audioMedia(video *VideoData) string {
+	if len(video.AudioTracks) < 2 {
+		return ""
+	}
+	var b strings.Builder
+	names := make(map[string]bool)
+	for _, t := range video.AudioTracks {
+		lang, langName := hlsLanguage(t.Language)
+		name := mediaName(names, t.Title, langName, "Audio", t.Index)
+
+		fmt.Fprintf(&b, `#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="%s"`, name)
+		if lang != "" {
+			fmt.Fprintf(&b, `,LANGUAGE="%s"`, lang)
+		}
+		fmt.Fprintf(&b, `,DEFAULT=%s,AUTOSELECT=YES,CHANNELS="2"`, yesNo(t.Index == 0))
+		if t.Index > 0 {
+			fmt.Fprintf(&b, `,URI="audio/%d/playlist.m3u8"`, t.Index)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func audioSegmentCached(video *VideoData, idx *KeyframeIndex, track, segNum int) bool {
+	start, duration := idx.Segment(segNum)
+	return segmentValid(audioSegmentFile(video.ID, track, segNum), start, duration, audioSignature)
+}
+
+// audioSegmentJob returns the queue key and the work needed to produce an
+// audio segment, through a temporary file like the video ones.
+func audioSegmentJob(video *VideoData, idx *KeyframeIndex, track, segNum int) (JobKey, func(ctx context.Context) error) {
+	key := JobKey{VideoID: video.ID, Rendition: audioRendition(track), Segment: segNum}
+	segmentPath := audioSegmentFile(video.ID, track, segNum)
+
+	return key, func(ctx context.Context) error {
+		if audioSegmentCached(video, idx, track, segNum) {
+			return nil
+		}
+		os.MkdirAll(filepath.Dir(segmentPath), 0755)
+
+		segCache.Pin(segmentPath)
+		defer segCache.Unpin(segmentPath)
+
+		start, duration := idx.Segment(segNum)
+		tmpPath := segmentPath + ".tmp"
+		fmt.Printf("[audio] generating track=%d seg=%d start=%.3fs dur=%.3fs\n", track, segNum, start, duration)
+		if err := GenerateAudioSegment(ctx, video.Path, tmpPath, track, start, duration); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		size, err := commitSegment(tmpPath, segmentPath, start, duration, audioSignature)
+		if err != nil {
+			return err
+		}
+		segCache.Add(segmentPath, size)
+		return nil
+	}
+}
+
+// GET /stream/:id/audio/:track/playlist.m3u8
+func HandleAudioPlaylist(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	if findAudioTrack(video, c.Param("track")) == nil {
+		c.String(404, "audio track not found")
+		return
+	}
+
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	c.String(200, indexPlaylist(GetKeyframeIndex(video), "segment_%d.ts"))
+}
+
+// GET /stream/:id/audio/:track/segment_:n.ts
+func HandleAudioSegment(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	track := findAudioTrack(video, c.Param("track"))
+	if track == nil {
+		c.String(404, "audio track not found")
+		return
+	}
+	idx := GetKeyframeIndex(video)
+	segNum, err := parseSegmentNum(c.Param("n"))
+	if err != nil || segNum < 0 || segNum >= idx.NumSegments() {
+		c.String(400, "invalid segment")
+		return
+	}
+	segmentPath := audioSegmentFile(video.ID, track.Index, segNum)
+
+	// The player fetches audio and video side by side: each has its own
+	// playhead, or one would orphan the prefetch of the other
+	viewer := viewerID(c) + "|audio"
+	key, run := audioSegmentJob(video, idx, track.Index, segNum)
+	setPlayhead(viewer, key)
+	transcoder.Reap()
+
+	segCache.Pin(segmentPath)
+	defer segCache.Unpin(segmentPath)
+
+	if audioSegmentCached(video, idx, track.Index, segNum) {
+		segCache.Hit(segmentPath)
+	} else {
+		segCache.Miss()
+		if err := transcoder.Run(c.Request.Context(), key, PriorityForeground, run); err != nil {
+			if c.Request.Context().Err() != nil {
+				forgetPlayhead(viewer, key)
+				transcoder.Reap()
+				return
+			}
+			fmt.Printf("[audio] error: %v\n", err)
+			c.String(500, "ffmpeg error")
+			return
+		}
+	}
+
+	for i := 1; i <= prefetchCount && segNum+i < idx.NumSegments(); i++ {
+		if !audioSegmentCached(video, idx, track.Index, segNum+i) {
+			key, run := audioSegmentJob(video, idx, track.Index, segNum+i)
+			transcoder.Submit(key, PriorityPrefetch, run)
+		}
+	}
+
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.File(segmentPath)
+}
@@ -0,0 +1,682 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const authFile = "/data/auth.json" // JSON store only
+
+const (
+	sessionCookie = "gazeparty_session"
+	sessionTTL    = 30 * 24 * time.Hour
+
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt ignores anything longer
+	maxUsernameLength = 64
+
+	userContextKey = "user"
+
+	loginFreeFailures = 5                // failed logins before the next ones are delayed
+	loginMaxDelay     = 15 * time.Minute // the delay doubles up to this
+	loginFailureTTL   = time.Hour        // failures older than this are forgotten
+)
+
+// User is an account. Admins manage users and the server, viewers watch.
+type User struct {
+	ID           int64     `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"` // bcrypt
+	Admin        bool      `json:"admin"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Role is "admin" or "viewer".
+func (u User) Role() string {
+	if u.Admin {
+		return "admin"
+	}
+	return "viewer"
+}
+
+// userInfo is a user as the API shows it, without the password hash.
+type userInfo struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (u User) info() userInfo {
+	return userInfo{ID: u.ID, Username: u.Username, Role: u.Role(), CreatedAt: u.CreatedAt}
+}
+
+// Session is a login. Only the SHA-256 of the cookie token is stored: a
+// copy of the database gives no usable session.
+type Session struct {
+	TokenHash string    `json:"token_hash"`
+	UserID    int64     `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// users and sessions mirror the store, loaded by LoadAndSyncVideos.
+// setupToken is printed to the console when there are no users: only who
+// can read it can create the first admin.
+var (
+	users      = make(map[int64]User)
+	sessions   = make(map[string]Session) // by token hash
+	setupToken string
+	authMu     sync.Mutex
+)
+
+// loginFailures counts the recent failed logins by client IP ("ip:...")
+// and by username ("user:...").
+var (
+	loginFailures   = make(map[string]loginFailure)
+	loginFailuresMu sync.Mutex
+)
+
+type loginFailure struct {
+	count int
+	last  time.Time
+}
+
+var (
+	errUserNotFound     = errors.New("user not found")
+	errUsernameTaken    = errors.New("username already taken")
+	errLastAdmin        = errors.New("the last admin cannot be removed or demoted")
+	errSetupDone        = errors.New("setup already done")
+	errBadSetupToken    = errors.New("invalid setup token")
+	errBadCredentials   = errors.New("invalid username or password")
+	errPasswordTooShort = fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	errPasswordTooLong  = fmt.Errorf("password must be at most %d bytes", maxPasswordLength)
+)
+
+// dummyHash is compared against when the username is unknown, so a login
+// takes as long whether or not the user exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("gazeparty"), bcrypt.DefaultCost)
+
+// loadUsers reads accounts and live sessions, and creates the first admin
+// from GAZEPARTY_ADMIN_USER and GAZEPARTY_ADMIN_PASSWORD when there is none;
+// without them a setup token is printed for /login.
+func loadUsers() error {
+	list, err := library.Users()
+	if err != nil {
+		return err
+	}
+	live, err := library.Sessions()
+	if err != nil {
+		return err
+	}
+
+	authMu.Lock()
+	for _, u := range list {
+		users[u.ID] = u
+	}
+	now := time.Now()
+	for _, s := range live {
+		if s.ExpiresAt.After(now) {
+			sessions[s.TokenHash] = s
+		}
+	}
+	empty := len(users) == 0
+	authMu.Unlock()
+
+	if !empty {
+		return nil
+	}
+	name, password := os.Getenv("GAZEPARTY_ADMIN_USER"), os.Getenv("GAZEPARTY_ADMIN_PASSWORD")
+	if name == "" || password == "" {
+		authMu.Lock()
+		setupToken = randomID(16)
+		authMu.Unlock()
+		fmt.Printf("[auth] no users: create the admin at /login with setup token %s, or set GAZEPARTY_ADMIN_USER and GAZEPARTY_ADMIN_PASSWORD\n", setupToken)
+		return nil
+	}
+	if _, err := createUser(name, password, true, true); err != nil {
+		return fmt.Errorf("creating admin %q: %w", name, err)
+	}
+	fmt.Printf("[auth] created admin %q\n", name)
+	return nil
+}
+
+// hashToken is the key a session token is stored under.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashPassword(password string) (string, error) {
+	switch {
+	case len(password) < minPasswordLength:
+		return "", invalidRequest(errPasswordTooShort.Error())
+	case len(password) > maxPasswordLength:
+		return "", invalidRequest(errPasswordTooLong.Error())
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// findUserLocked looks a username up, ignoring case.
+func findUserLocked(username string) (User, bool) {
+	for _, u := range users {
+		if strings.EqualFold(u.Username, username) {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+func adminCountLocked() int {
+	n := 0
+	for _, u := range users {
+		if u.Admin {
+			n++
+		}
+	}
+	return n
+}
+
+// createUser adds an account. With onlyFirst it fails unless there are no
+// users yet: that is the first-run setup.
+func createUser(username, password string, admin, onlyFirst bool) (User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" || len(username) > maxUsernameLength {
+		return User{}, invalidRequest(fmt.Sprintf("username must be 1-%d characters", maxUsernameLength))
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	authMu.Lock()
+	defer authMu.Unlock()
+	if onlyFirst && len(users) > 0 {
+		return User{}, errSetupDone
+	}
+	if _, taken := findUserLocked(username); taken {
+		return User{}, errUsernameTaken
+	}
+	u := User{ID: 1, Username: username, PasswordHash: hash, Admin: admin, CreatedAt: time.Now()}
+	for id := range users {
+		u.ID = max(u.ID, id+1)
+	}
+	if err := library.PutUser(u); err != nil {
+		return User{}, err
+	}
+	users[u.ID] = u
+	return u, nil
+}
+
+// updateUser changes the password and/or the role of an account. A new
+// password logs the user out everywhere.
+func updateUser(id int64, password *string, admin *bool) (User, error) {
+	var hash string
+	if password != nil {
+		var err error
+		if hash, err = hashPassword(*password); err != nil {
+			return User{}, err
+		}
+	}
+
+	authMu.Lock()
+	defer authMu.Unlock()
+	u, ok := users[id]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	if admin != nil {
+		if u.Admin && !*admin && adminCountLocked() == 1 {
+			return User{}, errLastAdmin
+		}
+		u.Admin = *admin
+	}
+	if password != nil {
+		u.PasswordHash = hash
+	}
+	if err := library.PutUser(u); err != nil {
+		return User{}, err
+	}
+	users[id] = u
+	if password != nil {
+		if err := deleteUserSessionsLocked(id); err != nil {
+			return User{}, err
+		}
+	}
+	return u, nil
+}
+
+// deleteUser removes an account with its sessions and watch progress.
+func deleteUser(id int64) error {
+	authMu.Lock()
+	defer authMu.Unlock()
+	u, ok := users[id]
+	if !ok {
+		return errUserNotFound
+	}
+	if u.Admin && adminCountLocked() == 1 {
+		return errLastAdmin
+	}
+	if err := library.DeleteUser(id); err != nil {
+		return err
+	}
+	delete(users, id)
+	for hash, s := range sessions {
+		if s.UserID == id {
+			delete(sessions, hash)
+		}
+	}
+	progressMu.Lock()
+	delete(progress, userKey(id))
+	progressMu.Unlock()
+	return nil
+}
+
+func deleteUserSessionsLocked(id int64) error {
+	var hashes []string
+	for hash, s := range sessions {
+		if s.UserID == id {
+			hashes = append(hashes, hash)
+		}
+	}
+	if err := library.DeleteSessions(hashes...); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		delete(sessions, hash)
+	}
+	return nil
+}
+
+// login checks the credentials and opens a session; returns the cookie token.
+func login(username, password string) (User, string, error) {
+	authMu.Lock()
+	u, ok := findUserLocked(strings.TrimSpace(username))
+	authMu.Unlock()
+
+	hash := dummyHash
+	if ok {
+		hash = []byte(u.PasswordHash)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return User{}, "", errBadCredentials
+	}
+
+	token := randomID(32)
+	now := time.Now()
+	s := Session{TokenHash: hashToken(token), UserID: u.ID, CreatedAt: now, ExpiresAt: now.Add(sessionTTL)}
+	authMu.Lock()
+	defer authMu.Unlock()
+	if err := library.PutSession(s); err != nil {
+		return User{}, "", err
+	}
+	sessions[s.TokenHash] = s
+	return u, token, nil
+}
+
+// loginDelay returns how long a login from ip as username must wait
+// because of earlier failures; 0 if it can go ahead.
+func loginDelay(ip, username string) time.Duration {
+	loginFailuresMu.Lock()
+	defer loginFailuresMu.Unlock()
+	var wait time.Duration
+	for _, key := range loginKeys(ip, username) {
+		f, ok := loginFailures[key]
+		if !ok || f.count < loginFreeFailures {
+			continue
+		}
+		delay := min(time.Second<<min(f.count-loginFreeFailures, 10), loginMaxDelay)
+		wait = max(wait, time.Until(f.last.Add(delay)))
+	}
+	return wait
+}
+
+// recordLoginFailure counts a failed login against ip and username.
+func recordLoginFailure(ip, username string) {
+	loginFailuresMu.Lock()
+	defer loginFailuresMu.Unlock()
+	now := time.Now()
+	for key, f := range loginFailures {
+		if now.Sub(f.last) > loginFailureTTL {
+			delete(loginFailures, key)
+		}
+	}
+	for _, key := range loginKeys(ip, username) {
+		f := loginFailures[key]
+		f.count++
+		f.last = now
+		loginFailures[key] = f
+	}
+}
+
+// clearLoginFailures forgets the failures of username after a good login.
+// Those of the IP stay: logging into one account must not allow guessing
+// more passwords of another.
+func clearLoginFailures(username string) {
+	loginFailuresMu.Lock()
+	defer loginFailuresMu.Unlock()
+	delete(loginFailures, loginUserKey(username))
+}
+
+func loginKeys(ip, username string) []string {
+	return []string{"ip:" + ip, loginUserKey(username)}
+}
+
+func loginUserKey(username string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+// checkSetupToken allows the first-run setup with the printed token only.
+func checkSetupToken(token string) error {
+	authMu.Lock()
+	defer authMu.Unlock()
+	if len(users) > 0 {
+		return errSetupDone
+	}
+	if setupToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(setupToken)) != 1 {
+		return errBadSetupToken
+	}
+	return nil
+}
+
+// sessionUser returns the user of a session token; expired sessions are dropped.
+func sessionUser(token string) (User, bool) {
+	hash := hashToken(token)
+	authMu.Lock()
+	defer authMu.Unlock()
+	s, ok := sessions[hash]
+	if !ok {
+		return User{}, false
+	}
+	if time.Now().After(s.ExpiresAt) {
+		delete(sessions, hash)
+		library.DeleteSessions(hash)
+		return User{}, false
+	}
+	u, ok := users[s.UserID]
+	return u, ok
+}
+
+func logout(token string) error {
+	hash := hashToken(token)
+	authMu.Lock()
+	defer authMu.Unlock()
+	if _, ok := sessions[hash]; !ok {
+		return nil
+	}
+	if err := library.DeleteSessions(hash); err != nil {
+		return err
+	}
+	delete(sessions, hash)
+	return nil
+}
+
+// setSessionCookie writes (or, with maxAge < 0, clears) the session cookie.
+// SameSite=Lax keeps it off cross-site POSTs, so forms on other sites can't
+// act on behalf of a logged-in user.
+func setSessionCookie(c *gin.Context, token string, maxAge int) {
+	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, token, maxAge, "/", "", secure, true)
+}
+
+// currentUser returns the user set by RequireUser.
+func currentUser(c *gin.Context) User {
+	u, _ := c.Get(userContextKey)
+	user, _ := u.(User)
+	return user
+}
+
+// userKey is the ID a user's watch progress is stored under.
+func userKey(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// RequireUser lets through requests with a valid session, 401 otherwise.
+func RequireUser(c *gin.Context) {
+	token, err := c.Cookie(sessionCookie)
+	if err != nil {
+		c.AbortWithStatusJSON(401, gin.H{"error": "login required"})
+		return
+	}
+	u, ok := sessionUser(token)
+	if !ok {
+		c.AbortWithStatusJSON(401, gin.H{"error": "login required"})
+		return
+	}
+	c.Set(userContextKey, u)
+	c.Next()
+}
+
+// RequireAdmin follows RequireUser and lets admins only through.
+func RequireAdmin(c *gin.Context) {
+	if !currentUser(c).Admin {
+		c.AbortWithStatusJSON(403, gin.H{"error": "admin only"})
+		return
+	}
+	c.Next()
+}
+
+// RequirePage is RequireUser for HTML pages: it sends visitors to the login
+// page, coming back here afterwards.
+func RequirePage(c *gin.Context) {
+	if token, err := c.Cookie(sessionCookie); err == nil {
+		if u, ok := sessionUser(token); ok {
+			c.Set(userContextKey, u)
+			c.Next()
+			return
+		}
+	}
+	c.Redirect(302, "/login?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+	c.Abort()
+}
+
+// authError writes err with the matching status.
+func authError(c *gin.Context, err error) {
+	var invalid invalidRequest
+	switch {
+	case errors.Is(err, errUserNotFound):
+		c.String(404, err.Error())
+	case errors.Is(err, errUsernameTaken), errors.Is(err, errLastAdmin), errors.Is(err, errSetupDone):
+		c.String(409, err.Error())
+	case errors.Is(err, errBadSetupToken):
+		c.String(403, err.Error())
+	case errors.As(err, &invalid):
+		c.String(400, err.Error())
+	default:
+		fmt.Printf("[auth] error: %v\n", err)
+		c.String(500, "error saving user")
+	}
+}
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// POST /auth/login {"username": "...", "password": "..."}
+// After loginFreeFailures failures from the same IP or for the same user
+// every attempt waits a delay doubling each time: 429 until it is over.
+func HandleLogin(c *gin.Context) {
+	var req credentials
+	if err := c.ShouldBindJSON(&req); err != nil || req.Username == "" || req.Password == "" {
+		c.String(400, "username and password required")
+		return
+	}
+	ip := c.ClientIP()
+	if wait := loginDelay(ip, req.Username); wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		c.String(429, "too many failed logins, retry later")
+		return
+	}
+	u, token, err := login(req.Username, req.Password)
+	if errors.Is(err, errBadCredentials) {
+		fmt.Printf("[auth] failed login for %q from %s\n", req.Username, ip)
+		recordLoginFailure(ip, req.Username)
+		c.String(401, err.Error())
+		return
+	}
+	if err != nil {
+		authError(c, err)
+		return
+	}
+	clearLoginFailures(req.Username)
+	setSessionCookie(c, token, int(sessionTTL.Seconds()))
+	claimViewerProgress(c, userKey(u.ID))
+	c.JSON(200, u.info())
+}
+
+// POST /auth/logout
+func HandleLogout(c *gin.Context) {
+	if token, err := c.Cookie(sessionCookie); err == nil {
+		if err := logout(token); err != nil {
+			authError(c, err)
+			return
+		}
+	}
+	setSessionCookie(c, "", -1)
+	c.Status(204)
+}
+
+// GET /auth/me
+func HandleMe(c *gin.Context) {
+	c.JSON(200, currentUser(c).info())
+}
+
+// GET /auth/setup tells the login page whether the first admin is missing.
+func HandleSetupStatus(c *gin.Context) {
+	authMu.Lock()
+	needed := len(users) == 0
+	authMu.Unlock()
+	c.JSON(200, gin.H{"needed": needed})
+}
+
+// POST /auth/setup {"username": "...", "password": "...", "token": "..."}
+// creates the first admin and logs it in. The token is the one printed at
+// startup; refused once any user exists.
+func HandleSetup(c *gin.Context) {
+	var req struct {
+		credentials
+		Token string `json:"token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.String(400, "username and password required")
+		return
+	}
+	if err := checkSetupToken(req.Token); err != nil {
+		fmt.Printf("[auth] refused setup from %s: %v\n", c.ClientIP(), err)
+		authError(c, err)
+		return
+	}
+	if _, err := createUser(req.Username, req.Password, true, true); err != nil {
+		authError(c, err)
+		return
+	}
+	authMu.Lock()
+	setupToken = ""
+	authMu.Unlock()
+	fmt.Printf("[auth] created admin %q from %s\n", req.Username, c.ClientIP())
+	u, token, err := login(req.Username, req.Password)
+	if err != nil {
+		authError(c, err)
+		return
+	}
+	setSessionCookie(c, token, int(sessionTTL.Seconds()))
+	claimViewerProgress(c, userKey(u.ID))
+	c.JSON(201, u.info())
+}
+
+// GET /admin/users
+func HandleListUsers(c *gin.Context) {
+	authMu.Lock()
+	list := make([]userInfo, 0, len(users))
+	for _, u := range users {
+		list = append(list, u.info())
+	}
+	authMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	c.JSON(200, list)
+}
+
+// POST /admin/users {"username": "...", "password": "...", "role": "viewer"}
+func HandleCreateUser(c *gin.Context) {
+	var req struct {
+		credentials
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.String(400, "invalid request")
+		return
+	}
+	if req.Role != "" && req.Role != "admin" && req.Role != "viewer" {
+		c.String(400, "role must be admin or viewer")
+		return
+	}
+	u, err := createUser(req.Username, req.Password, req.Role == "admin", false)
+	if err != nil {
+		authError(c, err)
+		return
+	}
+	c.JSON(201, u.info())
+}
+
+// PATCH /admin/users/:uid {"password": "...", "role": "admin"}, both optional
+func HandleUpdateUser(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("uid"), 10, 64)
+	if err != nil {
+		c.String(404, errUserNotFound.Error())
+		return
+	}
+	var req struct {
+		Password *string `json:"password"`
+		Role     *string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.String(400, "invalid request")
+		return
+	}
+	var admin *bool
+	if req.Role != nil {
+		if *req.Role != "admin" && *req.Role != "viewer" {
+			c.String(400, "role must be admin or viewer")
+			return
+		}
+		isAdmin := *req.Role == "admin"
+		admin = &isAdmin
+	}
+	u, err := updateUser(id, req.Password, admin)
+	if err != nil {
+		authError(c, err)
+		return
+	}
+	c.JSON(200, u.info())
+}
+
+// DELETE /admin/users/:uid
+func HandleDeleteUser(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("uid"), 10, 64)
+	if err != nil {
+		c.String(404, errUserNotFound.Error())
+		return
+	}
+	if err := deleteUser(id); err != nil {
+		authError(c, err)
+		return
+	}
+	c.Status(204)
+}
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// withAuthStore gives a test an empty JSON store and empty accounts, sessions,
+// watch progress and login failures.
+func withAuthStore(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := openJSONStore(filepath.Join(dir, "videos.json"), filepath.Join(dir, "collections.json"),
+		filepath.Join(dir, "progress.json"), filepath.Join(dir, "auth.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldLibrary, oldUsers, oldSessions, oldProgress := library, users, sessions, progress
+	oldToken, oldFailures := setupToken, loginFailures
+	library = store
+	users = make(map[int64]User)
+	sessions = make(map[string]Session)
+	progress = make(map[string]map[string]WatchProgress)
+	setupToken, loginFailures = "", make(map[string]loginFailure)
+	t.Cleanup(func() {
+		library, users, sessions, progress = oldLibrary, oldUsers, oldSessions, oldProgress
+		setupToken, loginFailures = oldToken, oldFailures
+	})
+}
+
+// loginAs creates a user and returns the token of a new session.
+func loginAs(t *testing.T, name string, admin bool) string {
+	t.Helper()
+	if _, err := createUser(name, "password123", admin, false); err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := login(name, "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func authRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/player", RequirePage, func(c *gin.Context) { c.String(200, currentUser(c).Username) })
+	api := r.Group("", RequireUser)
+	api.GET("/auth/me", HandleMe)
+	api.GET("/admin/users", RequireAdmin, HandleListUsers)
+	return r
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	withAuthStore(t)
+	admin := loginAs(t, "admin", true)
+	viewer := loginAs(t, "viewer", false)
+
+	expired := loginAs(t, "late", false)
+	authMu.Lock()
+	s := sessions[hashToken(expired)]
+	s.ExpiresAt = time.Now().Add(-time.Minute)
+	sessions[s.TokenHash] = s
+	authMu.Unlock()
+
+	tests := []struct {
+		name     string
+		path     string
+		token    string
+		want     int
+		location string
+	}{
+		{"no session", "/auth/me", "", 401, ""},
+		{"unknown token", "/auth/me", "bogus", 401, ""},
+		{"expired session", "/auth/me", expired, 401, ""},
+		{"viewer", "/auth/me", viewer, 200, ""},
+		{"viewer on admin route", "/admin/users", viewer, 403, ""},
+		{"admin on admin route", "/admin/users", admin, 200, ""},
+		{"page without session", "/player?id=x", "", 302, "/login?next=%2Fplayer%3Fid%3Dx"},
+		{"page with expired session", "/player", expired, 302, "/login?next=%2Fplayer"},
+		{"page with session", "/player", viewer, 200, ""},
+	}
+	r := authRouter()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.token != "" {
+				req.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.token})
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("GET %s = %d, want %d", tt.path, w.Code, tt.want)
+			}
+			if loc := w.Header().Get("Location"); loc != tt.location {
+				t.Errorf("Location = %q, want %q", loc, tt.location)
+			}
+		})
+	}
+
+	authMu.Lock()
+	_, kept := sessions[hashToken(expired)]
+	authMu.Unlock()
+	if kept {
+		t.Error("expired session not dropped")
+	}
+}
+
+func TestLoginClaimsViewerProgress(t *testing.T) {
+	withAuthStore(t)
+	if _, err := createUser("viewer", "password123", false, false); err != nil {
+		t.Fatal(err)
+	}
+	anon := strings.Repeat("ab", 16)
+	old, recent := time.Now().Add(-time.Hour), time.Now()
+	progress[anon] = map[string]WatchProgress{
+		"v1": {UserID: anon, VideoID: "v1", Position: 100, UpdatedAt: recent},
+		"v2": {UserID: anon, VideoID: "v2", Position: 200, UpdatedAt: old},
+	}
+	progress["1"] = map[string]WatchProgress{
+		"v2": {UserID: "1", VideoID: "v2", Position: 300, UpdatedAt: recent},
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/auth/login", HandleLogin)
+	req := httptest.NewRequest("POST", "/auth/login", strings.NewReader(`{"username":"viewer","password":"password123"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: viewerCookie, Value: anon})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("login = %d: %s", w.Code, w.Body)
+	}
+
+	if _, ok := progress[anon]; ok {
+		t.Error("anonymous progress kept")
+	}
+	if p := progress["1"]["v1"]; p.Position != 100 || p.UserID != "1" {
+		t.Errorf("v1 = %+v, want the anonymous position", p)
+	}
+	if p := progress["1"]["v2"]; p.Position != 300 {
+		t.Errorf("v2 = %+v, want the more recent user position", p)
+	}
+	cleared := false
+	for _, c := range w.Result().Cookies() {
+		cleared = cleared || c.Name == viewerCookie && c.MaxAge < 0
+	}
+	if !cleared {
+		t.Errorf("viewer cookie not cleared: %q", w.Header().Values("Set-Cookie"))
+	}
+}
+
+func TestAuthFileMode(t *testing.T) {
+	withAuthStore(t)
+	loginAs(t, "admin", true)
+	info, err := os.Stat(library.(*jsonStore).authPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode&0077 != 0 {
+		t.Errorf("auth.json mode = %v, want owner only", mode)
+	}
+}
+
+func postJSON(r *gin.Engine, path, body, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestLoginThrottle(t *testing.T) {
+	withAuthStore(t)
+	if _, err := createUser("viewer", "password123", false, false); err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/auth/login", HandleLogin)
+	bad := `{"username":"viewer","password":"wrong-password"}`
+	good := `{"username":"viewer","password":"password123"}`
+
+	for i := range loginFreeFailures {
+		if w := postJSON(r, "/auth/login", bad, "10.0.0.1"); w.Code != 401 {
+			t.Fatalf("failure %d = %d, want 401", i+1, w.Code)
+		}
+	}
+	w := postJSON(r, "/auth/login", good, "10.0.0.1")
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("login after %d failures = %d (Retry-After %q), want 429", loginFreeFailures, w.Code, w.Header().Get("Retry-After"))
+	}
+	// The username is throttled from any IP
+	if w := postJSON(r, "/auth/login", good, "10.0.0.2"); w.Code != 429 {
+		t.Errorf("same user from another IP = %d, want 429", w.Code)
+	}
+
+	// Once the delay is over a good login goes through and clears the user
+	loginFailuresMu.Lock()
+	for key, f := range loginFailures {
+		f.last = time.Now().Add(-time.Minute)
+		loginFailures[key] = f
+	}
+	loginFailuresMu.Unlock()
+	if w := postJSON(r, "/auth/login", good, "10.0.0.2"); w.Code != 200 {
+		t.Fatalf("login after the delay = %d, want 200", w.Code)
+	}
+	if d := loginDelay("10.0.0.3", "viewer"); d != 0 {
+		t.Errorf("user delay after a good login = %v, want 0", d)
+	}
+}
+
+func TestSetupToken(t *testing.T) {
+	withAuthStore(t)
+	setupToken = "secret-token"
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/auth/setup", HandleSetup)
+
+	tests := []struct {
+		name, body string
+		want       int
+	}{
+		{"no token", `{"username":"admin","password":"password123"}`, 403},
+		{"wrong token", `{"username":"admin","password":"password123","token":"guess"}`, 403},
+		{"token", `{"username":"admin","password":"password123","token":"secret-token"}`, 201},
+		{"setup done", `{"username":"other","password":"password123","token":"secret-token"}`, 409},
+	}
+	for _, tt := range tests {
+		if w := postJSON(r, "/auth/setup", tt.body, "10.0.0.1"); w.Code != tt.want {
+			t.Errorf("%s: POST /auth/setup = %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+	}
+	if setupToken != "" {
+		t.Error("setup token still valid after setup")
+	}
+}
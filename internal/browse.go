@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Folder is a subfolder in a /browse listing, with totals over everything below it.
+type Folder struct {
+	Name     string  `json:"name"`
+	Path     string  `json:"path"` // relative to videoDir
+	Videos   int     `json:"videos"`
+	Duration float64 `json:"duration"`
+}
+
+// FolderListing is the content of one folder of videoDir.
+type FolderListing struct {
+	Path     string      `json:"path"` // relative to videoDir, "" for the root
+	Parent   *string     `json:"parent"`
+	Folders  []Folder    `json:"folders"`
+	Videos   []VideoData `json:"videos"`
+	Total    int         `json:"total_videos"` // here and in every subfolder
+	Duration float64     `json:"total_duration"`
+}
+
+// cleanBrowsePath checks a path relative to videoDir; ".." is never allowed,
+// so the result always stays inside the library.
+func cleanBrowsePath(p string) (string, bool) {
+	p = strings.Trim(filepath.ToSlash(p), "/")
+	if p == "" {
+		return "", true
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+	return filepath.ToSlash(filepath.Clean(p)), true
+}
+
+// BrowseFolder lists a folder from the library (folders without videos are
+// not shown). ok is false if nothing in the library is there.
+func BrowseFolder(rel string) (FolderListing, bool) {
+	dir := videoDir
+	if rel != "" {
+		dir = filepath.Join(videoDir, filepath.FromSlash(rel))
+	}
+	prefix := dir + string(filepath.Separator)
+
+	listing := FolderListing{Path: rel, Folders: []Folder{}, Videos: []VideoData{}}
+	folders := make(map[string]*Folder)
+	for _, v := range GetVideos() {
+		if !strings.HasPrefix(v.Path, prefix) {
+			continue
+		}
+		listing.Total++
+		listing.Duration += v.Duration
+
+		sub, _, nested := strings.Cut(strings.TrimPrefix(v.Path, prefix), string(filepath.Separator))
+		if !nested {
+			listing.Videos = append(listing.Videos, v)
+			continue
+		}
+		f, ok := folders[sub]
+		if !ok {
+			f = &Folder{Name: sub, Path: strings.TrimPrefix(rel+"/"+sub, "/")}
+			folders[sub] = f
+		}
+		f.Videos++
+		f.Duration += v.Duration
+	}
+	if listing.Total == 0 && rel != "" {
+		return listing, false
+	}
+
+	for _, f := range folders {
+		listing.Folders = append(listing.Folders, *f)
+	}
+	sort.Slice(listing.Folders, func(i, j int) bool {
+		return foldText(listing.Folders[i].Name) < foldText(listing.Folders[j].Name)
+	})
+	sort.Slice(listing.Videos, func(i, j int) bool {
+		return foldText(listing.Videos[i].Name) < foldText(listing.Videos[j].Name)
+	})
+
+	if rel != "" {
+		parent := filepath.ToSlash(filepath.Dir(rel))
+		if parent == "." {
+			parent = ""
+		}
+		listing.Parent = &parent
+	}
+	return listing, true
+}
+
+// GET /browse?path=film/azione
+func HandleBrowse(c *gin.Context) {
+	rel, ok := cleanBrowsePath(c.Query("path"))
+	if !ok {
+		c.String(400, "invalid path")
+		return
+	}
+	listing, found := BrowseFolder(rel)
+	if !found {
+		c.String(404, "folder not found")
+		return
+	}
+	c.JSON(200, listing)
+}
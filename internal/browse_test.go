@@ -0,0 +1,31 @@
+package internal
+
+import "testing"
+
+func TestCleanBrowsePath(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   string
+		wantOK bool
+	}{
+		{"", "", true},
+		{"/", "", true},
+		{"Movies", "Movies", true},
+		{"/Movies/", "Movies", true},
+		{"Series/Show/Season 1", "Series/Show/Season 1", true},
+		{"Series//Show", "Series/Show", true},
+		{"Series/./Show", "Series/Show", true},
+		{"..", "", false},
+		{"../etc", "", false},
+		{"Movies/../..", "", false},
+		{"Movies/..", "", false},
+		{"/../video", "", false},
+		{"Movies/..hidden", "Movies/..hidden", true},
+	}
+	for _, tt := range tests {
+		got, ok := cleanBrowsePath(tt.in)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("cleanBrowsePath(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Players without WebVTT support can ask for the subtitles drawn on the
+// picture: ?subs=burn:<track> on the playlists and segments. The track is
+// converted once to ASS, which keeps the styling of ASS sources, and
+// rendered by ffmpeg's subtitles filter while encoding. Burned segments are
+// never remuxed nor taken from the optimized package, and live in their own
+// namespace (see segmentNamespace).
+
+const burnPrefix = "burn:"
+
+// parseBurn reads the subs parameter of a stream request: nil without one.
+// On an invalid value it answers the request and returns false.
+func parseBurn(c *gin.Context, video *VideoData) (*SubtitleRendition, bool) {
+	subs := c.Query("subs")
+	if subs == "" {
+		return nil, true
+	}
+	id, ok := strings.CutPrefix(subs, burnPrefix)
+	if !ok || id == "" {
+		c.String(400, "subs must be burn:<track>")
+		return nil, false
+	}
+	r := findSubtitle(video, id)
+	// Embedded tracks are extracted under the fingerprint
+	if r == nil || (r.sidecar == nil && video.Fingerprint == "") {
+		c.String(404, "subtitle track not found")
+		return nil, false
+	}
+	return r, true
+}
+
+// burnQuery is the query string that keeps a playlist URI on the burned variant.
+func burnQuery(r *SubtitleRendition) string {
+	return "?subs=" + burnPrefix + r.ID
+}
+
+// burnNamespace is the segment namespace of a burned track.
+func burnNamespace(r *SubtitleRendition) string {
+	return "burn_" + r.ID
+}
+
+// burnFile is the ASS copy of a track the filter reads, next to its WebVTT one.
+func burnFile(video *VideoData, r *SubtitleRendition) string {
+	if r.sidecar != nil {
+		return sidecarFile(*r.sidecar, "ass")
+	}
+	return subtitleFile(video.Fingerprint, r.stream, "ass")
+}
+
+// prepareBurnFile converts the track to ASS on first use. It runs inside a
+// segment job, so it takes a lock instead of a queue slot.
+func prepareBurnFile(ctx context.Context, video *VideoData, r *SubtitleRendition) error {
+	file := burnFile(video, r)
+	lock := getSegmentLock(file)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if fileExists(file) {
+		return nil
+	}
+	if r.sidecar != nil {
+		return convertSidecar(ctx, *r.sidecar, file, "ass")
+	}
+	return extractSubtitle(ctx, video, r.stream, file, "ass")
+}
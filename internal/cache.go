@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const segmentsDir = "/tmp/segments"
+
+// CacheManager keeps the segment cache under a size budget, evicting the least
+// recently used segments first. Segments being served or encoded are pinned
+// and never evicted.
+type CacheManager struct {
+	mu        sync.Mutex
+	maxBytes  int64
+	used      int64
+	lru       *list.List // front = most recently used
+	entries   map[string]*cacheEntry
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type cacheEntry struct {
+	path string // segment path; the sidecar goes with it
+	size int64  // segment + sidecar
+	pins int
+	elem *list.Element
+}
+
+// segCache is the cache of /tmp/segments.
+var segCache *CacheManager
+
+// StartCache indexes the segments already on disk and starts enforcing the
+// budget, in MB, from GAZEPARTY_CACHE_MB (default 2048).
+func StartCache() {
+	segCache = NewCacheManager(int64(envInt("GAZEPARTY_CACHE_MB", 2048)) * 1024 * 1024)
+	segCache.scan(segmentsDir)
+	fmt.Printf("[cache] started: max=%dMB used=%dMB entries=%d\n", segCache.maxBytes>>20, segCache.used>>20, len(segCache.entries))
+}
+
+// NewCacheManager creates an empty cache with the given budget.
+func NewCacheManager(maxBytes int64) *CacheManager {
+	return &CacheManager{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*cacheEntry),
+	}
+}
+
+// scan registers existing segments, oldest modification first, and removes
+// temporary files left by a crash.
+func (m *CacheManager) scan(root string) {
+	type found struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var segments []found
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			os.Remove(path)
+			return nil
+		}
+		if strings.HasSuffix(path, ".ts") {
+			size := info.Size()
+			if meta, err := os.Stat(segmentMetaPath(path)); err == nil {
+				size += meta.Size()
+			}
+			segments = append(segments, found{path, size, info.ModTime()})
+		}
+		return nil
+	})
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].modTime.Before(segments[j].modTime) })
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range segments {
+		m.addLocked(s.path, s.size)
+	}
+	m.evictLocked()
+}
+
+// Add records a segment just written (or rewritten) and evicts as needed.
+func (m *CacheManager) Add(path string, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addLocked(path, size)
+	m.evictLocked()
+}
+
+func (m *CacheManager) addLocked(path string, size int64) *cacheEntry {
+	e, ok := m.entries[path]
+	if !ok {
+		e = &cacheEntry{path: path}
+		e.elem = m.lru.PushFront(e)
+		m.entries[path] = e
+	} else {
+		m.lru.MoveToFront(e.elem)
+	}
+	m.used += size - e.size
+	e.size = size
+	return e
+}
+
+// Hit marks a segment as used by a viewer.
+func (m *CacheManager) Hit(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hits++
+	if e, ok := m.entries[path]; ok {
+		m.lru.MoveToFront(e.elem)
+	}
+}
+
+// Miss counts a segment that had to be generated.
+func (m *CacheManager) Miss() {
+	m.mu.Lock()
+	m.misses++
+	m.mu.Unlock()
+}
+
+// Pin protects a segment from eviction until the matching Unpin.
+// The segment does not need to exist yet (e.g. while it is being encoded).
+func (m *CacheManager) Pin(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addLocked(path, m.sizeLocked(path)).pins++
+}
+
+// Unpin releases a Pin.
+func (m *CacheManager) Unpin(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[path]; ok && e.pins > 0 {
+		e.pins--
+		// Pinned for an encode that never produced anything
+		if e.pins == 0 && e.size == 0 {
+			m.lru.Remove(e.elem)
+			delete(m.entries, path)
+		}
+	}
+	m.evictLocked()
+}
+
+// RemoveDir deletes every segment under dir (a video folder). Segments being
+// encoded are dropped from the accounting too: their commit fails.
+func (m *CacheManager) RemoveDir(dir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix := dir + string(filepath.Separator)
+	for path, e := range m.entries {
+		if strings.HasPrefix(path, prefix) {
+			m.lru.Remove(e.elem)
+			delete(m.entries, path)
+			m.used -= e.size
+		}
+	}
+	os.RemoveAll(dir)
+}
+
+func (m *CacheManager) sizeLocked(path string) int64 {
+	if e, ok := m.entries[path]; ok {
+		return e.size
+	}
+	return 0
+}
+
+// evictLocked removes least recently used, unpinned segments until the cache
+// fits the budget. m.mu must be held.
+func (m *CacheManager) evictLocked() {
+	elem := m.lru.Back()
+	for m.used > m.maxBytes && elem != nil {
+		e := elem.Value.(*cacheEntry)
+		elem = elem.Prev()
+		if e.pins > 0 {
+			continue
+		}
+
+		// The directory stays even when empty: an encode may have just
+		// created it for a segment it has not pinned yet
+		os.Remove(e.path)
+		os.Remove(segmentMetaPath(e.path))
+
+		m.lru.Remove(e.elem)
+		delete(m.entries, e.path)
+		m.used -= e.size
+		if e.size > 0 {
+			m.evictions++
+		}
+	}
+}
+
+// CacheStats is a snapshot of the segment cache, for the admin endpoint.
+type CacheStats struct {
+	MaxBytes  int64   `json:"max_bytes"`
+	UsedBytes int64   `json:"used_bytes"`
+	Entries   int     `json:"entries"`
+	Pinned    int     `json:"pinned"`
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	HitRatio  float64 `json:"hit_ratio"`
+	Evictions uint64  `json:"evictions"`
+}
+
+// Stats returns usage and hit/miss counters.
+func (m *CacheManager) Stats() CacheStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := CacheStats{
+		MaxBytes:  m.maxBytes,
+		UsedBytes: m.used,
+		Entries:   len(m.entries),
+		Hits:      m.hits,
+		Misses:    m.misses,
+		Evictions: m.evictions,
+	}
+	for _, e := range m.entries {
+		if e.pins > 0 {
+			stats.Pinned++
+		}
+	}
+	if total := m.hits + m.misses; total > 0 {
+		stats.HitRatio = float64(m.hits) / float64(total)
+	}
+	return stats
+}
+
+// GET /admin/cache
+func HandleCacheStats(c *gin.Context) {
+	c.JSON(200, segCache.Stats())
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writeSegment creates a segment with its sidecar and returns its path.
+func writeSegment(t *testing.T, dir, name string, size int) string {
+	t.Helper()
+	path := filepath.Join(dir, name+".ts")
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(segmentMetaPath(path), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// cached returns the names of the cached segments, most recently used first.
+func cached(m *CacheManager) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for elem := m.lru.Front(); elem != nil; elem = elem.Next() {
+		names = append(names, filepath.Base(elem.Value.(*cacheEntry).path))
+	}
+	return names
+}
+
+func TestCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	m := NewCacheManager(300)
+	seg := make(map[string]string)
+	for _, name := range []string{"a", "b", "c"} {
+		seg[name] = writeSegment(t, dir, name, 100)
+		m.Add(seg[name], 100)
+	}
+	m.Hit(seg["a"])
+
+	// Least recently used goes first, with its sidecar
+	seg["d"] = writeSegment(t, dir, "d", 100)
+	m.Add(seg["d"], 100)
+	if got, want := cached(m), []string{"d.ts", "a.ts", "c.ts"}; !slices.Equal(got, want) {
+		t.Errorf("after d: cached %v, want %v", got, want)
+	}
+	if fileExists(seg["b"]) || fileExists(segmentMetaPath(seg["b"])) {
+		t.Error("evicted segment b still on disk")
+	}
+
+	// A pinned segment survives even as the oldest one
+	m.Pin(seg["c"])
+	seg["e"] = writeSegment(t, dir, "e", 150)
+	m.Add(seg["e"], 150)
+	if got, want := cached(m), []string{"e.ts", "c.ts"}; !slices.Equal(got, want) {
+		t.Errorf("after e: cached %v, want %v", got, want)
+	}
+	if !fileExists(seg["c"]) {
+		t.Error("pinned segment c removed")
+	}
+
+	// Pins may hold the cache over budget until released
+	m.Pin(seg["e"])
+	seg["f"] = writeSegment(t, dir, "f", 200)
+	m.Pin(seg["f"])
+	m.Add(seg["f"], 200)
+	if stats := m.Stats(); stats.UsedBytes != 450 || stats.Pinned != 3 {
+		t.Errorf("pinned over budget: used=%d pinned=%d, want 450 and 3", stats.UsedBytes, stats.Pinned)
+	}
+	m.Unpin(seg["c"])
+	m.Unpin(seg["e"])
+	if got, want := cached(m), []string{"f.ts"}; !slices.Equal(got, want) {
+		t.Errorf("after unpin: cached %v, want %v", got, want)
+	}
+
+	stats := m.Stats()
+	if stats.UsedBytes != 200 || stats.Entries != 1 || stats.Evictions != 5 {
+		t.Errorf("used=%d entries=%d evictions=%d, want 200, 1, 5", stats.UsedBytes, stats.Entries, stats.Evictions)
+	}
+	if !fileExists(dir) {
+		t.Error("segment directory removed")
+	}
+}
+
+func TestCachePinWithoutSegment(t *testing.T) {
+	m := NewCacheManager(100)
+	path := filepath.Join(t.TempDir(), "0.ts")
+	m.Pin(path)
+	if stats := m.Stats(); stats.Entries != 1 || stats.Pinned != 1 {
+		t.Errorf("pinned encode: entries=%d pinned=%d, want 1 and 1", stats.Entries, stats.Pinned)
+	}
+	// The encode failed: nothing to account for
+	m.Unpin(path)
+	if stats := m.Stats(); stats.Entries != 0 || stats.Evictions != 0 {
+		t.Errorf("after a failed encode: entries=%d evictions=%d, want 0 and 0", stats.Entries, stats.Evictions)
+	}
+}
+
+func TestCacheCounters(t *testing.T) {
+	m := NewCacheManager(1000)
+	path := writeSegment(t, t.TempDir(), "0", 10)
+	m.Miss()
+	m.Add(path, 10)
+	m.Hit(path)
+	m.Hit(path)
+	m.Hit(path)
+	stats := m.Stats()
+	if stats.Hits != 3 || stats.Misses != 1 || stats.HitRatio != 0.75 {
+		t.Errorf("hits=%d misses=%d ratio=%v, want 3, 1, 0.75", stats.Hits, stats.Misses, stats.HitRatio)
+	}
+	if empty := NewCacheManager(1000).Stats(); empty.HitRatio != 0 {
+		t.Errorf("empty cache ratio = %v, want 0", empty.HitRatio)
+	}
+}
+
+func TestCacheScan(t *testing.T) {
+	dir := t.TempDir()
+	old := writeSegment(t, dir, "old", 100)
+	recent := writeSegment(t, dir, "recent", 100)
+	os.Chtimes(old, time.Now(), time.Now().Add(-time.Hour))
+	tmp := filepath.Join(dir, "partial.ts.tmp")
+	if err := os.WriteFile(tmp, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sizes include the sidecar: only one segment fits
+	m := NewCacheManager(150)
+	m.scan(dir)
+	if got, want := cached(m), []string{"recent.ts"}; !slices.Equal(got, want) {
+		t.Errorf("cached %v, want %v", got, want)
+	}
+	if fileExists(tmp) || fileExists(old) || !fileExists(recent) {
+		t.Error("scan left a temporary file or evicted the wrong segment")
+	}
+	if used := m.Stats().UsedBytes; used != 102 {
+		t.Errorf("used = %d, want 102 (segment + sidecar)", used)
+	}
+}
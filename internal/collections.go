@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const collectionsFile = "/data/collections.json" // JSON store only
+
+// Collection is a user-defined, ordered list of videos.
+type Collection struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	VideoIDs  []string  `json:"video_ids"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// collections mirrors the store, loaded by LoadAndSyncVideos.
+var (
+	collections   = make(map[string]Collection)
+	collectionsMu sync.Mutex
+)
+
+func loadCollections() error {
+	cols, err := library.Collections()
+	if err != nil {
+		return err
+	}
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+	for _, col := range cols {
+		collections[col.ID] = col
+	}
+	return nil
+}
+
+// canonicalVideoIDs resolves aliases to current IDs, drops duplicates and
+// fails on an unknown ID.
+func canonicalVideoIDs(ids []string) ([]string, error) {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, id := range ids {
+		v := GetVideoByID(id)
+		if v == nil {
+			return nil, invalidRequest("video not found: " + id)
+		}
+		if !seen[v.ID] {
+			seen[v.ID] = true
+			result = append(result, v.ID)
+		}
+	}
+	return result, nil
+}
+
+// updateCollection applies change to a copy of a collection and saves it.
+func updateCollection(id string, change func(col *Collection) error) (Collection, error) {
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+
+	col, ok := collections[id]
+	if !ok {
+		return Collection{}, errCollectionNotFound
+	}
+	col.VideoIDs = append([]string(nil), col.VideoIDs...)
+	if err := change(&col); err != nil {
+		return Collection{}, err
+	}
+	col.UpdatedAt = time.Now()
+	if err := library.PutCollection(col); err != nil {
+		return Collection{}, err
+	}
+	collections[id] = col
+	return col, nil
+}
+
+var errCollectionNotFound = errors.New("collection not found")
+
+// invalidRequest is an error caused by the request, answered with a 400.
+type invalidRequest string
+
+func (e invalidRequest) Error() string { return string(e) }
+
+// collectionError writes err with the matching status.
+func collectionError(c *gin.Context, err error) {
+	var invalid invalidRequest
+	switch {
+	case errors.Is(err, errCollectionNotFound):
+		c.String(404, err.Error())
+	case errors.As(err, &invalid):
+		c.String(400, err.Error())
+	default:
+		fmt.Printf("[collections] error: %v\n", err)
+		c.String(500, "error saving collection")
+	}
+}
+
+// GET /collections
+func HandleListCollections(c *gin.Context) {
+	collectionsMu.Lock()
+	list := make([]Collection, 0, len(collections))
+	for _, col := range collections {
+		list = append(list, col)
+	}
+	collectionsMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return foldText(list[i].Name) < foldText(list[j].Name) })
+	c.JSON(200, list)
+}
+
+// POST /collections {"name": "...", "video_ids": [...]}
+func HandleCreateCollection(c *gin.Context) {
+	var req struct {
+		Name     string   `json:"name"`
+		VideoIDs []string `json:"video_ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		c.String(400, "name required")
+		return
+	}
+	ids, err := canonicalVideoIDs(req.VideoIDs)
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+
+	now := time.Now()
+	col := Collection{ID: randomID(6), Name: strings.TrimSpace(req.Name), VideoIDs: ids, CreatedAt: now, UpdatedAt: now}
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+	if err := library.PutCollection(col); err != nil {
+		collectionError(c, err)
+		return
+	}
+	collections[col.ID] = col
+	c.JSON(201, col)
+}
+
+// GET /collections/:cid returns the collection with its videos; videos no
+// longer in the library are skipped and counted as missing.
+func HandleGetCollection(c *gin.Context) {
+	collectionsMu.Lock()
+	col, ok := collections[c.Param("cid")]
+	collectionsMu.Unlock()
+	if !ok {
+		c.String(404, errCollectionNotFound.Error())
+		return
+	}
+
+	videos := []VideoData{}
+	for _, id := range col.VideoIDs {
+		if v := GetVideoByID(id); v != nil {
+			videos = append(videos, *v)
+		}
+	}
+	c.JSON(200, gin.H{
+		"id":         col.ID,
+		"name":       col.Name,
+		"video_ids":  col.VideoIDs,
+		"videos":     videos,
+		"missing":    len(col.VideoIDs) - len(videos),
+		"created_at": col.CreatedAt,
+		"updated_at": col.UpdatedAt,
+	})
+}
+
+// PATCH /collections/:cid {"name": "...", "video_ids": [...]}, both optional;
+// video_ids replaces the list (and its order).
+func HandleUpdateCollection(c *gin.Context) {
+	var req struct {
+		Name     *string   `json:"name"`
+		VideoIDs *[]string `json:"video_ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.String(400, "invalid request")
+		return
+	}
+	col, err := updateCollection(c.Param("cid"), func(col *Collection) error {
+		if req.Name != nil {
+			name := strings.TrimSpace(*req.Name)
+			if name == "" {
+				return invalidRequest("name required")
+			}
+			col.Name = name
+		}
+		if req.VideoIDs != nil {
+			ids, err := canonicalVideoIDs(*req.VideoIDs)
+			if err != nil {
+				return err
+			}
+			col.VideoIDs = ids
+		}
+		return nil
+	})
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+	c.JSON(200, col)
+}
+
+// POST /collections/:cid/videos {"video_id": "..."} appends a video.
+func HandleAddToCollection(c *gin.Context) {
+	var req struct {
+		VideoID string `json:"video_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.VideoID == "" {
+		c.String(400, "video_id required")
+		return
+	}
+	col, err := updateCollection(c.Param("cid"), func(col *Collection) error {
+		ids, err := canonicalVideoIDs([]string{req.VideoID})
+		if err != nil {
+			return err
+		}
+		if !containsString(col.VideoIDs, ids[0]) {
+			col.VideoIDs = append(col.VideoIDs, ids[0])
+		}
+		return nil
+	})
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+	c.JSON(200, col)
+}
+
+// DELETE /collections/:cid/videos/:id
+func HandleRemoveFromCollection(c *gin.Context) {
+	id := c.Param("id")
+	if v := GetVideoByID(id); v != nil {
+		id = v.ID
+	}
+	col, err := updateCollection(c.Param("cid"), func(col *Collection) error {
+		kept := col.VideoIDs[:0]
+		for _, x := range col.VideoIDs {
+			if x != id {
+				kept = append(kept, x)
+			}
+		}
+		col.VideoIDs = kept
+		return nil
+	})
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+	c.JSON(200, col)
+}
+
+// DELETE /collections/:cid
+func HandleDeleteCollection(c *gin.Context) {
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+
+	id := c.Param("cid")
+	if _, ok := collections[id]; !ok {
+		c.String(404, errCollectionNotFound.Error())
+		return
+	}
+	if err := library.DeleteCollection(id); err != nil {
+		collectionError(c, err)
+		return
+	}
+	delete(collections, id)
+	c.Status(204)
+}
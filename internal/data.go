@@ -1,41 +1,157 @@
 package internal
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
-// VideoData represents video info stored in the data file.
-// This file tracks only base video information (hash, path, name, resolution, duration).
+// VideoData represents video info stored in the library.
+// This file tracks base video information (hash, path, name) plus the ffprobe metadata.
 const dataDir = "/data"
-const dataFile = "/data/videos.json"
+const dataFile = "/data/videos.json" // JSON store, or imported by the SQLite one
 
 type VideoData struct {
-	ID       string  `json:"id"`
-	Path     string  `json:"path"`
-	Name     string  `json:"name"`
-	Duration float64 `json:"duration"`
-	Width    int     `json:"width"`
-	Height   int     `json:"height"`
+	ID          string   `json:"id"` // stable, see identity.go
+	Path        string   `json:"path"`
+	Name        string   `json:"name"`
+	Fingerprint string   `json:"fingerprint"`         // content, see fileFingerprint
+	Aliases     []string `json:"aliases,omitempty"`   // IDs of videos merged into this one
+	AltPaths    []string `json:"alt_paths,omitempty"` // copies merged into this one
+	Size        int64    `json:"size"`
+	ModTime     int64    `json:"mtime"` // unix nanoseconds
+	Inode       uint64   `json:"inode"`
+	MediaInfo
+	Sidecars        []SidecarSubtitle  `json:"sidecars,omitempty"`         // subtitle files next to the video
+	SubtitleOffsets map[string]float64 `json:"subtitle_offsets,omitempty"` // seconds, by subtitle track key
+}
+
+// HLSCompatible reports whether the source can be remuxed into HLS segments
+// as is: H.264 8-bit 4:2:0 video with AAC (or no) audio.
+func (v *VideoData) HLSCompatible() bool {
+	return v.VideoCodec == "h264" && v.PixFmt == "yuv420p" && (v.AudioCodec == "aac" || v.AudioCodec == "")
 }
 
+// videoCache is replaced, never modified in place, so pointers returned by
+// GetVideoByID stay valid. videoIndex maps IDs and aliases to positions in it.
 var (
 	videoCache []VideoData
+	videoIndex map[string]int
 	cacheMu    sync.RWMutex
 )
 
-// LoadAndSyncVideos scans videos in parallel (4 workers), syncs with data file.
-func LoadAndSyncVideos() ([]VideoData, error) {
-	cacheMu.Lock()
-	defer cacheMu.Unlock()
+// setVideoCacheLocked swaps in a new library. cacheMu must be held.
+func setVideoCacheLocked(videos []VideoData) {
+	index := make(map[string]int, len(videos))
+	for i, v := range videos {
+		for _, alias := range v.Aliases {
+			index[alias] = i
+		}
+	}
+	for i, v := range videos {
+		index[v.ID] = i
+	}
+	videoCache, videoIndex = videos, index
+}
+
+// Rescan modes: quick reuses entries whose size, mtime and inode are unchanged,
+// full re-hashes and re-probes every file and rebuilds its keyframe index.
+const (
+	RescanQuick = "quick"
+	RescanFull  = "full"
+)
+
+// RescanProgress reports the state of the current (or last) rescan.
+type RescanProgress struct {
+	Running    bool      `json:"running"`
+	Mode       string    `json:"mode"`
+	Total      int       `json:"total"`
+	Done       int       `json:"done"`
+	Reused     int       `json:"reused"`  // unchanged, not read
+	Scanned    int       `json:"scanned"` // hashed and probed
+	Failed     int       `json:"failed"`
+	Added      int       `json:"added"`
+	Removed    int       `json:"removed"`
+	Updated    int       `json:"updated"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+}
+
+var (
+	rescanProgress RescanProgress
+	rescanMu       sync.Mutex
+)
 
+// ErrRescanRunning is returned when a rescan is requested while one is running.
+var ErrRescanRunning = errors.New("rescan already running")
+
+// LoadAndSyncVideos opens the library store and runs a quick rescan at startup.
+func LoadAndSyncVideos() ([]VideoData, error) {
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data dir: %w", err)
 	}
+	store, err := openLibraryStore()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open library: %w", err)
+	}
+	library = store
+	if err := loadCollections(); err != nil {
+		return nil, fmt.Errorf("failed to load collections: %w", err)
+	}
+	if err := loadProgress(); err != nil {
+		return nil, fmt.Errorf("failed to load watch progress: %w", err)
+	}
+	if err := loadUsers(); err != nil {
+		return nil, fmt.Errorf("failed to load users: %w", err)
+	}
+	return Rescan(RescanQuick)
+}
+
+// GetRescanProgress returns a snapshot of the rescan progress.
+func GetRescanProgress() RescanProgress {
+	rescanMu.Lock()
+	defer rescanMu.Unlock()
+	return rescanProgress
+}
+
+// Rescan scans videos in parallel (3 workers) and syncs the library with the
+// store. The library stays readable while files are being scanned, and
+// edits made meanwhile are kept (see mergeLiveLocked).
+func Rescan(mode string) ([]VideoData, error) {
+	if err := startRescan(mode); err != nil {
+		return nil, err
+	}
+	return runRescan(mode)
+}
+
+// startRescan marks a rescan as running, or returns ErrRescanRunning.
+// The caller must then call runRescan.
+func startRescan(mode string) error {
+	rescanMu.Lock()
+	defer rescanMu.Unlock()
+	if rescanProgress.Running {
+		return ErrRescanRunning
+	}
+	rescanProgress = RescanProgress{Running: true, Mode: mode, StartedAt: time.Now()}
+	return nil
+}
+
+// runRescan does the rescan claimed by startRescan.
+func runRescan(mode string) ([]VideoData, error) {
+	defer func() {
+		rescanMu.Lock()
+		rescanProgress.Running = false
+		rescanProgress.FinishedAt = time.Now()
+		rescanMu.Unlock()
+	}()
 
 	// Collect paths
 	var paths []string
@@ -46,14 +162,32 @@ func LoadAndSyncVideos() ([]VideoData, error) {
 		return nil
 	})
 
-	// Process files in parallel (4 workers)
+	// Known entries by path, to skip unchanged files
+	existing := GetVideos()
+	fromCache := existing != nil
+	if !fromCache {
+		stored, err := library.Videos()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read library: %w", err)
+		}
+		existing = stored
+	}
+	byPath := make(map[string]VideoData, len(existing))
+	for _, v := range existing {
+		byPath[v.Path] = v
+	}
+
+	rescanMu.Lock()
+	rescanProgress.Total = len(paths)
+	rescanMu.Unlock()
+
+	// Process files in parallel (3 workers)
 	results := make(chan VideoData, len(paths))
 	sem := make(chan struct{}, 3)
 	var wg sync.WaitGroup
 
 	// mark begin time
 	startTime := time.Now()
-	done := 0
 	for _, path := range paths {
 		wg.Add(1)
 		go func(p string) {
@@ -61,6 +195,40 @@ func LoadAndSyncVideos() ([]VideoData, error) {
 			sem <- struct{}{}
 			defer func() { <-sem }()
 
+			if mode != RescanFull {
+				if old, ok := byPath[p]; ok && unchangedOnDisk(old) {
+					if old.Fingerprint == "" {
+						// Recorded before fingerprints: hash only, no probe
+						fp, err := fileFingerprint(p)
+						if err != nil {
+							fmt.Printf("[data] error hashing %s: %v\n", p, err)
+							rescanStep(func(pr *RescanProgress) { pr.Failed++ })
+							return
+						}
+						old.Fingerprint = fp
+					}
+					if old.ProbeVersion < mediaProbeVersion {
+						// Probed before MediaInfo had every field
+						info, title, err := probeMedia(p)
+						if err != nil {
+							fmt.Printf("[data] error probing %s: %v\n", p, err)
+						}
+						old.MediaInfo, old.Name = info, title
+					}
+					// Subtitle files come and go on their own
+					old.Sidecars = findSidecars(p)
+					results <- old
+					rescanStep(func(pr *RescanProgress) { pr.Reused++ })
+					return
+				}
+			}
+
+			if old, ok := byPath[p]; ok && mode == RescanFull {
+				// Full rescans redo the timing too
+				forgetKeyframeIndex(old.ID)
+			}
+
+			done := GetRescanProgress().Done
 			fmt.Printf(
 				"[data] [speed %.2fv/s] [count %d/%d] processing %s  \n",
 				float64(done+1)/time.Since(startTime).Seconds(),
@@ -68,44 +236,52 @@ func LoadAndSyncVideos() ([]VideoData, error) {
 				len(paths),
 				p,
 			)
-			hash, err := fileHashHeadTail(p, 1)
+			v, err := scanVideoFile(p)
 			if err != nil {
 				fmt.Printf("[data] error hashing %s: %v\n", p, err)
+				rescanStep(func(pr *RescanProgress) { pr.Failed++ })
 				return
 			}
-			duration, _ := videoDuration(p)
-			width, height, _ := videoResolution(p)
-			results <- VideoData{ID: hash, Path: p, Name: videoTitle(p), Duration: duration, Width: width, Height: height}
-			done++
+			results <- v
+			rescanStep(func(pr *RescanProgress) { pr.Scanned++ })
 		}(path)
 	}
 
 	go func() { wg.Wait(); close(results) }()
 
-	// Build map from scanned files
-	scanned := make(map[string]VideoData)
+	// Same file, same ID: identities come from the known videos, not the scan
+	var files []VideoData
+	present := make(map[string]bool, len(paths))
 	for v := range results {
+		files = append(files, v)
+		present[v.Path] = true
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	scanned := make(map[string]VideoData)
+	for _, v := range resolveIdentities(existing, files, func(p string) bool { return present[p] }) {
 		scanned[v.ID] = v
 	}
 
 	// Reconcile with existing data
-	existing := loadDataFile()
 	existingMap := make(map[string]VideoData)
 	for _, v := range existing {
 		existingMap[v.ID] = v
 	}
 
-	var result []VideoData
+	var result, changed []VideoData
+	var gone []string
 	var added, removed, updated int
 
 	for id, v := range scanned {
 		if old, found := existingMap[id]; found {
-			if old.Path != v.Path || old.Duration != v.Duration || old.Width != v.Width || old.Height != v.Height {
+			if !reflect.DeepEqual(old, v) {
 				fmt.Printf("[data] updated: %s\n", v.Path)
+				changed = append(changed, v)
 				updated++
 			}
 		} else {
 			fmt.Printf("[data] new: %s\n", v.Path)
+			changed = append(changed, v)
 			added++
 		}
 		result = append(result, v)
@@ -114,19 +290,237 @@ func LoadAndSyncVideos() ([]VideoData, error) {
 	for id, v := range existingMap {
 		if _, found := scanned[id]; !found {
 			fmt.Printf("[data] removed: %s\n", v.Path)
+			gone = append(gone, id)
 			removed++
 		}
 	}
 
-	fmt.Printf("[data] sync: added=%d removed=%d updated=%d\n", added, removed, updated)
-	if err := saveDataFile(result); err != nil {
-		fmt.Printf("[data] error saving: %v\n", err)
-	}
+	fmt.Printf("[data] sync (%s): added=%d removed=%d updated=%d in %v\n", mode, added, removed, updated, time.Since(startTime).Round(time.Millisecond))
+	rescanMu.Lock()
+	rescanProgress.Added, rescanProgress.Removed, rescanProgress.Updated = added, removed, updated
+	rescanMu.Unlock()
 
-	videoCache = result
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if fromCache {
+		result, changed, gone = mergeLiveLocked(existing, result, changed, gone)
+	}
+	saveChanges(changed, gone)
+	setVideoCacheLocked(result)
 	return result, nil
 }
 
+// mergeLiveLocked lets the library edits made while a rescan was running
+// (watcher, subtitle offsets, merges) win over its results: every video that
+// differs from the snapshot the rescan started from is kept as it is now.
+// cacheMu must be held.
+func mergeLiveLocked(snapshot, result, changed []VideoData, gone []string) ([]VideoData, []VideoData, []string) {
+	before := make(map[string]VideoData, len(snapshot))
+	for _, v := range snapshot {
+		before[v.ID] = v
+	}
+	edited := make(map[string]bool)
+	editedPaths := make(map[string]bool)
+	current := make(map[string]bool, len(videoCache))
+	var live []VideoData
+	for _, v := range videoCache {
+		current[v.ID] = true
+		if old, ok := before[v.ID]; ok && reflect.DeepEqual(old, v) {
+			continue
+		}
+		edited[v.ID] = true
+		editedPaths[v.Path] = true
+		live = append(live, v)
+	}
+	for _, v := range snapshot {
+		if !current[v.ID] {
+			// Removed or merged meanwhile
+			edited[v.ID] = true
+		}
+	}
+	if len(edited) == 0 {
+		return result, changed, gone
+	}
+
+	// The scan may have given a file added meanwhile an ID of its own
+	stale := func(v VideoData) bool { return edited[v.ID] || editedPaths[v.Path] }
+	var merged, save []VideoData
+	for _, v := range result {
+		if !stale(v) {
+			merged = append(merged, v)
+		}
+	}
+	for _, v := range changed {
+		if !stale(v) {
+			save = append(save, v)
+		}
+	}
+	var deleted []string
+	for _, id := range gone {
+		if !edited[id] {
+			deleted = append(deleted, id)
+		}
+	}
+	return append(merged, live...), save, deleted
+}
+
+// saveChanges writes library changes to the store. A failure is logged, not
+// returned: the in-memory library stays right and the next rescan retries.
+func saveChanges(put []VideoData, deleted []string) {
+	if len(deleted) > 0 {
+		if err := library.DeleteVideos(deleted...); err != nil {
+			fmt.Printf("[data] error saving: %v\n", err)
+		}
+	}
+	if len(put) > 0 {
+		if err := library.PutVideos(put...); err != nil {
+			fmt.Printf("[data] error saving: %v\n", err)
+		}
+	}
+}
+
+// rescanStep counts one more file done and updates the other counters.
+func rescanStep(update func(pr *RescanProgress)) {
+	rescanMu.Lock()
+	defer rescanMu.Unlock()
+	rescanProgress.Done++
+	update(&rescanProgress)
+}
+
+// unchangedOnDisk reports whether the file of v still has the size, mtime
+// and inode recorded at the last scan, so its content needs no re-reading.
+func unchangedOnDisk(v VideoData) bool {
+	if v.Size == 0 {
+		return false
+	}
+	info, err := os.Stat(v.Path)
+	if err != nil {
+		return false
+	}
+	return info.Size() == v.Size && info.ModTime().UnixNano() == v.ModTime && fileInode(info) == v.Inode
+}
+
+// scanVideoFile hashes and probes a single file. Only a hashing error is
+// fatal: probe errors are recorded in the returned VideoData.
+// The ID is left empty, see resolveIdentities.
+func scanVideoFile(p string) (VideoData, error) {
+	stat, err := os.Stat(p)
+	if err != nil {
+		return VideoData{}, err
+	}
+	fingerprint, err := fileFingerprint(p)
+	if err != nil {
+		return VideoData{}, err
+	}
+	info, title, err := probeMedia(p)
+	if err != nil {
+		// Still listed: the error is kept in probe_error
+		fmt.Printf("[data] error probing %s: %v\n", p, err)
+	}
+	return VideoData{
+		Path:        p,
+		Name:        title,
+		Fingerprint: fingerprint,
+		Size:        stat.Size(),
+		ModTime:     stat.ModTime().UnixNano(),
+		Inode:       fileInode(stat),
+		MediaInfo:   info,
+		Sidecars:    findSidecars(p),
+	}, nil
+}
+
+// UpsertVideoFile rescans one file and updates library and store.
+// Returns the video and whether it is new to the library; a merged copy of
+// another video returns that video, unchanged.
+func UpsertVideoFile(p string) (VideoData, bool, error) {
+	scanned, err := scanVideoFile(p)
+	if err != nil {
+		return VideoData{}, false, err
+	}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	// A moved file shows up as removed first: those are candidates too
+	known := append(append([]VideoData(nil), videoCache...), recentlyRemoved()...)
+	resolved := resolveIdentities(known, []VideoData{scanned}, func(path string) bool {
+		return path == p || fileExists(path)
+	})
+	if len(resolved) == 0 {
+		for _, owner := range videoCache {
+			if containsString(owner.AltPaths, p) {
+				return owner, false, nil
+			}
+		}
+		return VideoData{}, false, fmt.Errorf("%s not resolved", p)
+	}
+	v := resolved[0]
+	forgetRemoved(v.ID)
+
+	// Copy on write: pointers from GetVideoByID stay valid
+	added := true
+	result := make([]VideoData, 0, len(videoCache)+1)
+	for _, old := range videoCache {
+		if old.ID == v.ID {
+			added = false
+			continue
+		}
+		result = append(result, old)
+	}
+	result = append(result, v)
+
+	saveChanges([]VideoData{v}, nil)
+	setVideoCacheLocked(result)
+	return v, added, nil
+}
+
+// RemoveVideoPath drops every video at path or below it (a removed folder)
+// and returns the removed ones. Merged copies there are forgotten; a video
+// whose listed file is gone moves to one of its copies.
+func RemoveVideoPath(p string) []VideoData {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	under := func(path string) bool {
+		return path == p || strings.HasPrefix(path, p+string(filepath.Separator))
+	}
+
+	var removed, changed []VideoData
+	var gone []string
+	result := make([]VideoData, 0, len(videoCache))
+	for _, v := range videoCache {
+		var altPaths []string
+		for _, alt := range v.AltPaths {
+			if !under(alt) {
+				altPaths = append(altPaths, alt)
+			}
+		}
+		if under(v.Path) && len(altPaths) > 0 {
+			// Same content, so nothing derived from it changes
+			fmt.Printf("[data] %s now served from %s\n", v.ID, altPaths[0])
+			v.Path, altPaths = altPaths[0], altPaths[1:]
+		}
+		if under(v.Path) {
+			removed = append(removed, v)
+			gone = append(gone, v.ID)
+			continue
+		}
+		if len(altPaths) != len(v.AltPaths) {
+			v.AltPaths = altPaths
+			changed = append(changed, v)
+		}
+		result = append(result, v)
+	}
+	if len(removed) == 0 && len(changed) == 0 {
+		return nil
+	}
+
+	saveChanges(changed, gone)
+	setVideoCacheLocked(result)
+	rememberRemoved(removed)
+	return removed
+}
+
 // GetVideos returns the cached video list.
 func GetVideos() []VideoData {
 	cacheMu.RLock()
@@ -138,37 +532,38 @@ func GetVideos() []VideoData {
 func GetVideoByID(id string) *VideoData {
 	cacheMu.RLock()
 	defer cacheMu.RUnlock()
-	for i := range videoCache {
-		if videoCache[i].ID == id {
-			return &videoCache[i]
-		}
+	if i, ok := videoIndex[id]; ok {
+		return &videoCache[i]
 	}
 	return nil
 }
 
-func loadDataFile() []VideoData {
-	data, err := os.ReadFile(dataFile)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			fmt.Printf("[data] error reading file: %v\n", err)
-		}
-		return nil
+// POST /admin/rescan?mode=quick|full
+func HandleRescan(c *gin.Context) {
+	mode := c.DefaultQuery("mode", RescanQuick)
+	if mode != RescanQuick && mode != RescanFull {
+		c.String(400, "mode must be quick or full")
+		return
 	}
-
-	var videos []VideoData
-	if err := json.Unmarshal(data, &videos); err != nil {
-		fmt.Printf("[data] error parsing file: %v\n", err)
-		return nil
+	// Claimed here, so two requests cannot both start one
+	if err := startRescan(mode); err != nil {
+		c.String(409, err.Error())
+		return
 	}
 
-	fmt.Printf("[data] loaded %d videos from file\n", len(videos))
-	return videos
+	go func() {
+		videos, err := runRescan(mode)
+		if err != nil {
+			fmt.Printf("[data] rescan: %v\n", err)
+			return
+		}
+		QueueThumbnails(videos...)
+		publishLibraryEvent(LibraryEvent{Type: "rescanned"})
+	}()
+	c.JSON(202, gin.H{"mode": mode})
 }
 
-func saveDataFile(videos []VideoData) error {
-	data, err := json.MarshalIndent(videos, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(dataFile, data, 0644)
+// GET /admin/rescan
+func HandleRescanProgress(c *gin.Context) {
+	c.JSON(200, GetRescanProgress())
 }
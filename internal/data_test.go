@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"errors"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMergeLiveLocked(t *testing.T) {
+	snapshot := []VideoData{
+		{ID: "same", Path: "/video/same.mkv"},
+		{ID: "offset", Path: "/video/offset.mkv"},
+		{ID: "removed", Path: "/video/removed.mkv"},
+		{ID: "gone", Path: "/video/gone.mkv"},
+	}
+	// What the rescan found: a new ID for a file the watcher added meanwhile
+	result := []VideoData{
+		{ID: "same", Path: "/video/same.mkv", Name: "rescanned"},
+		{ID: "offset", Path: "/video/offset.mkv", Name: "rescanned"},
+		{ID: "removed", Path: "/video/removed.mkv"},
+		{ID: "scan-new", Path: "/video/new.mkv"},
+	}
+	changed := []VideoData{result[0], result[1], result[3]}
+	gone := []string{"gone"}
+
+	// Edits made while the rescan ran
+	withLibrary(t, []VideoData{
+		{ID: "same", Path: "/video/same.mkv"},
+		{ID: "offset", Path: "/video/offset.mkv", SubtitleOffsets: map[string]float64{"0": 1.5}},
+		{ID: "gone", Path: "/video/gone.mkv"},
+		{ID: "watched-new", Path: "/video/new.mkv"},
+	})
+
+	cacheMu.Lock()
+	merged, save, deleted := mergeLiveLocked(snapshot, result, changed, gone)
+	cacheMu.Unlock()
+
+	ids := func(videos []VideoData) string {
+		var out []string
+		for _, v := range videos {
+			out = append(out, v.ID+":"+v.Name)
+		}
+		sort.Strings(out)
+		return strings.Join(out, " ")
+	}
+	if got, want := ids(merged), "offset: same:rescanned watched-new:"; got != want {
+		t.Errorf("merged = %q, want %q", got, want)
+	}
+	if got, want := ids(save), "same:rescanned"; got != want {
+		t.Errorf("saved = %q, want %q", got, want)
+	}
+	if len(deleted) != 1 || deleted[0] != "gone" {
+		t.Errorf("deleted = %v, want [gone]", deleted)
+	}
+	for _, v := range merged {
+		if v.ID == "offset" && v.SubtitleOffsets["0"] != 1.5 {
+			t.Error("subtitle offset set during the rescan lost")
+		}
+	}
+}
+
+func TestStartRescan(t *testing.T) {
+	rescanMu.Lock()
+	old := rescanProgress
+	rescanProgress = RescanProgress{}
+	rescanMu.Unlock()
+	t.Cleanup(func() {
+		rescanMu.Lock()
+		rescanProgress = old
+		rescanMu.Unlock()
+	})
+
+	if err := startRescan(RescanQuick); err != nil {
+		t.Fatalf("first claim: %v", err)
+	}
+	if err := startRescan(RescanFull); !errors.Is(err, ErrRescanRunning) {
+		t.Errorf("second claim = %v, want ErrRescanRunning", err)
+	}
+	if p := GetRescanProgress(); p.Mode != RescanQuick {
+		t.Errorf("mode = %q, want the first claim", p.Mode)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/admin/rescan", HandleRescan)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/rescan?mode=full", nil))
+	if w.Code != 409 {
+		t.Errorf("POST while running = %d, want 409", w.Code)
+	}
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LibraryEvent tells connected clients that the library changed.
+type LibraryEvent struct {
+	Type string `json:"type"` // added, updated, removed, rescanned
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	Name string `json:"name"`
+}
+
+// eventHub fans library events out to every Server-Sent Events client.
+var eventHub = struct {
+	mu   sync.Mutex
+	subs map[chan LibraryEvent]struct{}
+}{subs: make(map[chan LibraryEvent]struct{})}
+
+// publishLibraryEvent sends ev to every subscriber without blocking:
+// a client too slow to keep up misses it, and reloads on the next one.
+func publishLibraryEvent(ev LibraryEvent) {
+	eventHub.mu.Lock()
+	defer eventHub.mu.Unlock()
+	for ch := range eventHub.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func subscribeLibrary() chan LibraryEvent {
+	ch := make(chan LibraryEvent, 16)
+	eventHub.mu.Lock()
+	eventHub.subs[ch] = struct{}{}
+	eventHub.mu.Unlock()
+	return ch
+}
+
+func unsubscribeLibrary(ch chan LibraryEvent) {
+	eventHub.mu.Lock()
+	delete(eventHub.subs, ch)
+	eventHub.mu.Unlock()
+}
+
+// GET /events
+func HandleEvents(c *gin.Context) {
+	ch := subscribeLibrary()
+	defer unsubscribeLibrary(ch)
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case ev := <-ch:
+			c.SSEvent("library", ev)
+			return true
+		case <-keepalive.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
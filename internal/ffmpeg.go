@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"math"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 )
 
 // GenerateSegment creates a segment file on disk (original implementation).
@@ -114,30 +116,96 @@ func GenerateSegmentV3(ctx context.Context, videoPath, outputPath string, startS
 
 // ...existing code...
 
+// EncodeParams describes the video output of an encode.
+// Width/Height at zero keep the source resolution.
+type EncodeParams struct {
+	CRF         int     // libx264 quality, 15-30 (software encoder only)
+	BitrateKbps int     // target video bitrate: drives the hw encoder, caps libx264
+	Width       int     // output width, 0 = source
+	Height      int     // output height, 0 = source
+	Level       string  // H.264 level, default "3.1"
+	FrameRate   float64 // source frame rate, sizes the GOP (0 = assume 24fps)
+	VideoStream int     // source stream encoded, see MediaInfo.VideoStream
+
+	Subtitles      string  // ASS file drawn on the picture, "" = none
+	SubtitleOffset float64 // seconds added to the subtitle times
+}
+
+// Signature describes the encode, down to the encoder actually used, so that
+// cached segments made with different settings are recognized as stale.
+func (p EncodeParams) Signature() string {
+	encoder := "libx264"
+	if os.Getenv("GAZEPARTY_RPI") == "1" {
+		encoder = "h264_v4l2m2m"
+	}
+	sig := fmt.Sprintf("%s crf=%d bitrate=%dk size=%dx%d level=%s fps=%.3f",
+		encoder, p.CRF, p.BitrateKbps, p.Width, p.Height, p.Level, p.FrameRate)
+	if p.Subtitles != "" {
+		sig += fmt.Sprintf(" subs=%s offset=%.3f", p.Subtitles, p.SubtitleOffset)
+	}
+	if p.VideoStream != 0 {
+		sig += fmt.Sprintf(" stream=%d", p.VideoStream)
+	}
+	return sig
+}
+
+// remuxSignature marks segments cut from the source with -c copy.
+const remuxSignature = "copy"
+
 // GenerateSegmentV4 creates a segment with proper handling for both software and hardware encoders.
 // On Raspberry Pi (GAZEPARTY_RPI=1), uses h264_v4l2m2m with bitrate control.
-// On other systems, uses libx264 with CRF quality control.
-// bitrateMbps: target bitrate in Megabits (e.g., 3 for 3M), used only for hardware encoder.
-func GenerateSegmentV4(ctx context.Context, videoPath, outputPath string, startSec, durationSec, crf, bitrateMbps int) error {
-	// Use background context so FFmpeg isn't killed if client disconnects
-	ctx = context.Background()
-
+// On other systems, uses libx264 with CRF quality control, capped at BitrateKbps when set.
+// When p.Width/p.Height are set the output is scaled, so the same function serves every ABR rendition.
+// startSec/durationSec come from the keyframe index: the first frame is always forced
+// to a keyframe and the GOP spans the whole segment, whatever the frame rate.
+// ctx is the job context: cancelling it kills ffmpeg (the caller removes the partial output).
+func GenerateSegmentV4(ctx context.Context, videoPath, outputPath string, startSec, durationSec float64, p EncodeParams) error {
 	// Seek veloce a 10 sec prima, poi preciso
 	preSeek := max(0, startSec-10)
 	preciseSeek := startSec - preSeek
 
-	gop := strconv.Itoa(durationSec * 24)
-	start := strconv.Itoa(startSec)
+	fps := p.FrameRate
+	if fps <= 0 {
+		fps = 24
+	}
+	// One GOP per segment: the only keyframe is the forced one at the boundary
+	gop := strconv.Itoa(int(math.Ceil(durationSec*fps)) + 1)
+	start := formatSeconds(startSec)
 
 	// Base args comuni
 	args := []string{
 		"-y",
 		"-hide_banner", "-loglevel", "error",
-		"-ss", strconv.Itoa(preSeek),
+		"-ss", formatSeconds(preSeek),
 		"-i", videoPath,
-		"-ss", strconv.Itoa(preciseSeek),
-		"-t", strconv.Itoa(durationSec),
-		"-map", "0:v:0", "-map", "0:a:0?", "-sn", "-dn",
+		"-ss", formatSeconds(preciseSeek),
+		"-t", formatSeconds(durationSec),
+		"-map", videoStreamMap(p.VideoStream), "-map", "0:a:0?", "-sn", "-dn",
+		"-force_key_frames", "expr:eq(n,0)",
+	}
+
+	var filters []string
+	if p.Subtitles != "" {
+		// The filter sees timestamps from the input seek point: move them to
+		// source time (minus the offset) for the subtitles, then back
+		shift := formatSeconds(preSeek - p.SubtitleOffset)
+		filters = append(filters,
+			"setpts=PTS+("+shift+")/TB",
+			"subtitles=filename="+filterPath(p.Subtitles),
+			"setpts=PTS-("+shift+")/TB",
+		)
+	}
+	// Scala solo se richiesto (rendition ABR)
+	if p.Width > 0 && p.Height > 0 {
+		filters = append(filters, fmt.Sprintf("scale=%d:%d", p.Width, p.Height))
+	}
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+
+	level := p.Level
+	if level == "" {
+		level = "3.1"
 	}
 
 	// Scegli encoder e parametri in base all'ambiente
@@ -149,10 +217,11 @@ func GenerateSegmentV4(ctx context.Context, videoPath, outputPath string, startS
 		// - NO preset/tune support
 		// - GOP flags spesso ignorati
 		// - Richiede pix_fmt yuv420p esplicito PRIMA dell'encoder
-		if bitrateMbps <= 0 {
-			bitrateMbps = 3 // Default 3 Mbps
+		bitrateKbps := p.BitrateKbps
+		if bitrateKbps <= 0 {
+			bitrateKbps = 3000 // Default 3 Mbps
 		}
-		bitrate := strconv.Itoa(bitrateMbps) + "M"
+		bitrate := strconv.Itoa(bitrateKbps) + "k"
 
 		args = append(args,
 			"-pix_fmt", "yuv420p", // DEVE essere prima di -c:v per hw encoder
@@ -163,18 +232,25 @@ func GenerateSegmentV4(ctx context.Context, videoPath, outputPath string, startS
 		fmt.Printf("[ffmpeg] Using h264_v4l2m2m hardware encoder @ %s bitrate\n", bitrate)
 	} else {
 		// Software encoder: libx264 con CRF
-		if crf < 15 || crf > 30 {
-			fmt.Printf("[ffmpeg] WARNING: CRF=%d is outside recommended range 15-30\n", crf)
+		if p.CRF < 15 || p.CRF > 30 {
+			fmt.Printf("[ffmpeg] WARNING: CRF=%d is outside recommended range 15-30\n", p.CRF)
 		}
 
 		args = append(args,
 			"-c:v", "libx264",
 			"-preset", "ultrafast", "-tune", "zerolatency",
-			"-crf", strconv.Itoa(crf),
-			"-profile:v", "main", "-level", "3.1",
+			"-crf", strconv.Itoa(p.CRF),
+			"-profile:v", "main", "-level", level,
 			"-pix_fmt", "yuv420p",
 			"-g", gop, "-keyint_min", gop, "-sc_threshold", "0",
 		)
+		// CRF capped VBV, so renditions stay within their advertised bandwidth
+		if p.BitrateKbps > 0 {
+			args = append(args,
+				"-maxrate", strconv.Itoa(p.BitrateKbps)+"k",
+				"-bufsize", strconv.Itoa(p.BitrateKbps*2)+"k",
+			)
+		}
 	}
 
 	// Audio args (comuni a entrambi)
@@ -203,3 +279,84 @@ func GenerateSegmentV4(ctx context.Context, videoPath, outputPath string, startS
 
 	return nil
 }
+
+// RemuxSegment cuts a segment out of an HLS-compatible source (H.264 + AAC)
+// without re-encoding. startSec must be a source keyframe, so the input seek
+// lands exactly on it and the segment starts decodable.
+func RemuxSegment(ctx context.Context, videoPath, outputPath string, videoStream int, startSec, durationSec float64) error {
+	start := formatSeconds(startSec)
+	args := []string{
+		"-y",
+		"-hide_banner", "-loglevel", "error",
+		"-ss", start,
+		"-i", videoPath,
+		"-t", formatSeconds(durationSec),
+		"-map", videoStreamMap(videoStream), "-map", "0:a:0?", "-sn", "-dn",
+		"-c", "copy",
+		"-output_ts_offset", start,
+		"-f", "mpegts", "-muxdelay", "0", "-muxpreload", "0",
+		outputPath,
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg remux failed: %w\n%s", err, stderr.String())
+	}
+	return nil
+}
+
+// GenerateAudioSegment encodes audio stream 0:a:track alone, for the
+// alternate audio renditions. Same cut and timestamps as the video segments,
+// so the player can line the two up and switch track at any segment.
+func GenerateAudioSegment(ctx context.Context, videoPath, outputPath string, track int, startSec, durationSec float64) error {
+	// Seek veloce a 10 sec prima, poi preciso
+	preSeek := max(0, startSec-10)
+	preciseSeek := startSec - preSeek
+
+	args := []string{
+		"-y",
+		"-hide_banner", "-loglevel", "error",
+		"-ss", formatSeconds(preSeek),
+		"-i", videoPath,
+		"-ss", formatSeconds(preciseSeek),
+		"-t", formatSeconds(durationSec),
+		"-map", fmt.Sprintf("0:a:%d", track), "-vn", "-sn", "-dn",
+		"-c:a", "aac", "-b:a", strconv.Itoa(audioBitrateKbps) + "k", "-ac", "2", "-ar", "48000",
+		"-af", "aresample=async=1:first_pts=0",
+		"-output_ts_offset", formatSeconds(startSec),
+		"-f", "mpegts", "-muxdelay", "0", "-muxpreload", "0",
+		outputPath,
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg audio failed: %w\n%s", err, stderr.String())
+	}
+	return nil
+}
+
+// videoStreamMap selects the source stream at index: with cover art first,
+// 0:v:0 would be the picture attached to the file.
+func videoStreamMap(index int) string {
+	return "0:" + strconv.Itoa(index)
+}
+
+// formatSeconds formats a timestamp for ffmpeg with microsecond precision.
+func formatSeconds(sec float64) string {
+	return strconv.FormatFloat(sec, 'f', 6, 64)
+}
+
+// filterPath escapes a file path for a filter option: once for the option
+// value, once more for the filtergraph.
+func filterPath(path string) string {
+	value := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(path)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(value)
+}
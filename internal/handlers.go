@@ -3,7 +3,9 @@ package internal
 import (
 	"context"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -13,16 +15,16 @@ import (
 
 const (
 	videoDir        = "/video"
-	segmentDuration = 4
+	segmentDuration = 4 // target: real segments end on the next keyframe
 )
 
-// segmentLocks prevents concurrent encoding of the same segment
+// segmentLocks serializes slow per-video work (e.g. the keyframe probe)
 var (
 	segmentLocks   = make(map[string]*sync.Mutex)
 	segmentLocksMu sync.Mutex
 )
 
-// getSegmentLock returns a mutex for a specific segment (video_id + segment_num)
+// getSegmentLock returns a mutex for a specific key
 func getSegmentLock(key string) *sync.Mutex {
 	segmentLocksMu.Lock()
 	defer segmentLocksMu.Unlock()
@@ -32,9 +34,19 @@ func getSegmentLock(key string) *sync.Mutex {
 	return segmentLocks[key]
 }
 
-// GET /files
+// GET /files?q=&codec=&folder=&min_duration=&max_duration=&min_height=&max_height=&sort=&order=&limit=&cursor=
 func HandleFiles(c *gin.Context) {
-	c.JSON(200, GetVideos())
+	q, err := parseVideoQuery(c)
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	page, err := SearchVideos(q)
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	c.JSON(200, page)
 }
 
 // GET /stream/:id/playlist.m3u8
@@ -45,116 +57,285 @@ func HandlePlaylist(c *gin.Context) {
 		return
 	}
 
-	numSegments := int(video.Duration/segmentDuration) + 1
-	fmt.Printf("[playlist] path=%s duration=%.1fs segments=%d\n", video.Path, video.Duration, numSegments)
+	burn, ok := parseBurn(c, video)
+	if !ok {
+		return
+	}
+
+	// Complete pre-transcoded package: serve its own playlist
+	if path := optimizedPlaylistFile(video.ID); burn == nil && optimizedComplete(video.ID) {
+		c.Header("Content-Type", "application/vnd.apple.mpegurl")
+		c.File(path)
+		return
+	}
+
+	writeMediaPlaylist(c, video, burn)
+}
+
+// writeMediaPlaylist writes the VOD media playlist of a video. Segment URIs are
+// relative, so the same playlist serves the single quality stream and every rendition.
+// With burned-in subtitles every URI carries the subs parameter.
+func writeMediaPlaylist(c *gin.Context, video *VideoData, burn *SubtitleRendition) {
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	if burn == nil {
+		c.String(200, mediaPlaylist(video))
+		return
+	}
+	c.String(200, indexPlaylist(GetKeyframeIndex(video), "segment_%d.ts"+burnQuery(burn)))
+}
+
+// mediaPlaylist builds the media playlist of a video.
+// Segment durations are the real ones from the keyframe index.
+func mediaPlaylist(video *VideoData) string {
+	idx := GetKeyframeIndex(video)
+	numSegments := idx.NumSegments()
+	fmt.Printf("[playlist] path=%s duration=%.1fs segments=%d fps=%.3f\n", video.Path, video.Duration, numSegments, idx.FrameRate)
+	return indexPlaylist(idx, "segment_%d.ts")
+}
+
+// indexPlaylist writes a VOD playlist with one entry per segment of the
+// keyframe index; uriFormat names segment N. Subtitle renditions use it too,
+// so their segments line up with the video ones.
+func indexPlaylist(idx *KeyframeIndex, uriFormat string) string {
+	numSegments := idx.NumSegments()
 
 	var b strings.Builder
 	b.WriteString("#EXTM3U\n")
 	b.WriteString("#EXT-X-VERSION:3\n")
-	b.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", segmentDuration))
+	b.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(idx.MaxSegmentDuration()))))
 	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
 	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
 
 	for i := 0; i < numSegments; i++ {
-		segDur := float64(segmentDuration)
-		if i == numSegments-1 {
-			segDur = video.Duration - float64(i*segmentDuration)
-		}
-		b.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", segDur))
-		b.WriteString(fmt.Sprintf("segment_%d.ts\n", i))
+		_, segDur := idx.Segment(i)
+		b.WriteString(fmt.Sprintf("#EXTINF:%.6f,\n", segDur))
+		b.WriteString(fmt.Sprintf(uriFormat+"\n", i))
 	}
 	b.WriteString("#EXT-X-ENDLIST\n")
-
-	c.Header("Content-Type", "application/vnd.apple.mpegurl")
-	c.String(200, b.String())
+	return b.String()
 }
 
 // GET /stream/:id/segment_:n.ts
 func HandleSegment(c *gin.Context) {
-	id := c.Param("id")
-	video := GetVideoByID(id)
+	video := GetVideoByID(c.Param("id"))
 	if video == nil {
 		c.String(404, "video not found")
 		return
 	}
 
-	segStr := c.Param("n")
-	segStr = strings.TrimPrefix(segStr, "segment_")
+	serveSegment(c, video, nil)
+}
+
+// parseSegmentNum extracts N from a "segment_N.ts" path parameter.
+func parseSegmentNum(param string) (int, error) {
+	segStr := strings.TrimPrefix(param, "segment_")
 	segStr = strings.TrimSuffix(segStr, ".ts")
-	segNum, err := strconv.Atoi(segStr)
-	if err != nil {
+	return strconv.Atoi(segStr)
+}
+
+// segmentFile returns where a segment is cached: the single quality stream
+// lives in /tmp/segments/:id/, every rendition in its own /tmp/segments/:id/:rendition/.
+// Burned-in subtitles get their own tree, /tmp/segments/:id/burn_:track/[:rendition/].
+func segmentFile(id string, rendition *Rendition, burn *SubtitleRendition, segNum int) string {
+	return filepath.Join(segmentDir(id, rendition, burn), fmt.Sprintf("segment_%d.ts", segNum))
+}
+
+func segmentDir(id string, rendition *Rendition, burn *SubtitleRendition) string {
+	return filepath.Join(segmentsDir, id, segmentNamespace(rendition, burn))
+}
+
+// segmentNamespace names a variant of the video segments, on disk and in the
+// queue: "" for the single quality stream, "720p", "burn_2", "burn_2/720p".
+func segmentNamespace(rendition *Rendition, burn *SubtitleRendition) string {
+	var parts []string
+	if burn != nil {
+		parts = append(parts, burnNamespace(burn))
+	}
+	if rendition != nil {
+		parts = append(parts, rendition.Name)
+	}
+	return strings.Join(parts, "/")
+}
+
+// encodeParams returns the encoder settings for a rendition (nil = single quality),
+// with the subtitle track to burn in, if any.
+func encodeParams(video *VideoData, idx *KeyframeIndex, rendition *Rendition, burn *SubtitleRendition) EncodeParams {
+	p := EncodeParams{CRF: 23, BitrateKbps: 3000, FrameRate: idx.FrameRate, VideoStream: video.VideoStream}
+	if rendition != nil {
+		p.BitrateKbps = rendition.BitrateKbps
+		p.Width = rendition.Width
+		p.Height = rendition.Height
+		p.Level = rendition.Level
+	}
+	if burn != nil {
+		p.Subtitles = burnFile(video, burn)
+		p.SubtitleOffset = burn.Offset
+	}
+	return p
+}
+
+// serveSegment generates (if needed) and serves a segment of the given rendition.
+// Encoding goes through the transcode queue with foreground priority; if the
+// viewer goes away before it is ready, the encode is cancelled.
+func serveSegment(c *gin.Context, video *VideoData, rendition *Rendition) {
+	burn, ok := parseBurn(c, video)
+	if !ok {
+		return
+	}
+	idx := GetKeyframeIndex(video)
+	segNum, err := parseSegmentNum(c.Param("n"))
+	if err != nil || segNum < 0 || segNum >= idx.NumSegments() {
 		c.String(400, "invalid segment")
 		return
 	}
 
 	// Segment file path
-	segmentPath := fmt.Sprintf("/tmp/segments/%s/segment_%d.ts", id, segNum)
-	segmentKey := fmt.Sprintf("%s_%d", id, segNum)
-
-	// Lock this segment to prevent concurrent encoding
-	lock := getSegmentLock(segmentKey)
-	lock.Lock()
-	defer lock.Unlock()
-
-	// Check if already exists (after acquiring lock)
-	if _, err := os.Stat(segmentPath); err != nil {
-		// Create directory
-		os.MkdirAll(fmt.Sprintf("/tmp/segments/%s", id), 0755)
-
-		// Generate segment with CRF (software) or bitrate (hardware on RPI)
-		startTime := segNum * segmentDuration
-		crf := 23
-		bitrateMbps := 3
-		fmt.Printf("[segment] generating seg=%d start=%ds crf=%d bitrate=%dM\n", segNum, startTime, crf, bitrateMbps)
-
-		if err := GenerateSegmentV4(c.Request.Context(), video.Path, segmentPath, startTime, segmentDuration, crf, bitrateMbps); err != nil {
+	segmentPath := segmentFile(video.ID, rendition, burn, segNum)
+
+	// A pre-transcoded package wins over the temporary cache
+	if rendition == nil && burn == nil {
+		if optPath := optimizedSegmentFile(video.ID, segNum); segmentUpToDate(optPath, video, idx, nil, nil, segNum) {
+			c.Header("Cache-Control", "public, max-age=3600")
+			c.File(optPath)
+			return
+		}
+	}
+
+	// Move the viewer playhead: prefetch left behind by a seek is now orphaned
+	viewer := viewerID(c)
+	key, run := segmentJob(video, idx, rendition, burn, segNum)
+	setPlayhead(viewer, key)
+	transcoder.Reap()
+
+	// Pinned until served, so eviction can't remove it under our feet
+	segCache.Pin(segmentPath)
+	defer segCache.Unpin(segmentPath)
+
+	if segmentCached(video, idx, rendition, burn, segNum) {
+		segCache.Hit(segmentPath)
+	} else {
+		segCache.Miss()
+		if err := transcoder.Run(c.Request.Context(), key, PriorityForeground, run); err != nil {
+			if c.Request.Context().Err() != nil {
+				// Client gone (tab closed or seeked away): nothing to answer
+				forgetPlayhead(viewer, key)
+				transcoder.Reap()
+				return
+			}
 			fmt.Printf("[segment] error: %v\n", err)
 			c.String(500, "ffmpeg error")
 			return
 		}
 	}
 
-	// Prefetch next 2 segments in background
-	go prefetchSegments(video, segNum, 2)
+	// Prefetch next segments in background
+	prefetchSegments(video, idx, rendition, burn, segNum, prefetchCount)
 
 	c.Header("Cache-Control", "public, max-age=3600")
 	c.File(segmentPath)
 }
 
-// prefetchSegments encodes the next N segments in background
-func prefetchSegments(video *VideoData, currentSeg, count int) {
-	numSegments := int(video.Duration/segmentDuration) + 1
-	crf := 23
-	bitrateMbps := 3
+// segmentCached reports whether the cached segment is complete and was
+// produced the way we would produce it now.
+func segmentCached(video *VideoData, idx *KeyframeIndex, rendition *Rendition, burn *SubtitleRendition, segNum int) bool {
+	return segmentUpToDate(segmentFile(video.ID, rendition, burn, segNum), video, idx, rendition, burn, segNum)
+}
 
-	for i := 1; i <= count; i++ {
-		nextSeg := currentSeg + i
-		if nextSeg >= numSegments {
-			break
+// segmentUpToDate checks the segment at path against its sidecar.
+func segmentUpToDate(path string, video *VideoData, idx *KeyframeIndex, rendition *Rendition, burn *SubtitleRendition, segNum int) bool {
+	start, duration := idx.Segment(segNum)
+	accepted := []string{encodeParams(video, idx, rendition, burn).Signature()}
+	if canRemux(video, idx, rendition, burn) {
+		accepted = append(accepted, remuxSignature)
+	}
+	return segmentValid(path, start, duration, accepted...)
+}
+
+// segmentJob returns the queue key and the work needed to produce a segment.
+// ffmpeg writes to a temporary file renamed into place only on success, so a
+// failed or cancelled encode never leaves a partial segment behind.
+func segmentJob(video *VideoData, idx *KeyframeIndex, rendition *Rendition, burn *SubtitleRendition, segNum int) (JobKey, func(ctx context.Context) error) {
+	key := JobKey{VideoID: video.ID, Rendition: segmentNamespace(rendition, burn), Segment: segNum}
+	segmentPath := segmentFile(video.ID, rendition, burn, segNum)
+
+	return key, func(ctx context.Context) error {
+		// A previous job may have produced it while this one was queued
+		if segmentCached(video, idx, rendition, burn, segNum) {
+			return nil
 		}
+		os.MkdirAll(segmentDir(video.ID, rendition, burn), 0755)
 
-		segmentPath := fmt.Sprintf("/tmp/segments/%s/segment_%d.ts", video.ID, nextSeg)
-		segmentKey := fmt.Sprintf("%s_%d", video.ID, nextSeg)
+		segCache.Pin(segmentPath)
+		defer segCache.Unpin(segmentPath)
 
-		// Try to acquire lock - if already locked, someone else is encoding it
-		lock := getSegmentLock(segmentKey)
-		if !lock.TryLock() {
-			fmt.Printf("[prefetch] seg=%d already being encoded, skipping\n", nextSeg)
-			continue
+		size, err := encodeSegment(ctx, video, idx, rendition, burn, segNum, segmentPath)
+		if err != nil {
+			return err
 		}
+		segCache.Add(segmentPath, size)
+		return nil
+	}
+}
 
-		// Check if already exists (after acquiring lock)
-		if _, err := os.Stat(segmentPath); err == nil {
-			lock.Unlock()
-			continue
+// encodeSegment produces a segment at segmentPath through a temporary file and
+// commits it with its sidecar. Returns the bytes written.
+func encodeSegment(ctx context.Context, video *VideoData, idx *KeyframeIndex, rendition *Rendition, burn *SubtitleRendition, segNum int, segmentPath string) (int64, error) {
+	tmpPath := segmentPath + ".tmp"
+	params, err := generateSegment(ctx, video, idx, rendition, burn, segNum, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	start, duration := idx.Segment(segNum)
+	return commitSegment(tmpPath, segmentPath, start, duration, params)
+}
+
+// canRemux reports whether a segment can be cut with -c copy: only the single
+// quality stream of an HLS-compatible source with keyframe-aligned boundaries,
+// and no subtitles to draw on the picture.
+func canRemux(video *VideoData, idx *KeyframeIndex, rendition *Rendition, burn *SubtitleRendition) bool {
+	return rendition == nil && burn == nil && video.HLSCompatible() && idx.KeyframeAligned()
+}
+
+// generateSegment writes segment segNum to outputPath and returns the signature
+// of the params used. Remuxable segments use -c copy; everything else is
+// transcoded, as is a remux that fails.
+func generateSegment(ctx context.Context, video *VideoData, idx *KeyframeIndex, rendition *Rendition, burn *SubtitleRendition, segNum int, outputPath string) (string, error) {
+	startTime, duration := idx.Segment(segNum)
+
+	if canRemux(video, idx, rendition, burn) {
+		fmt.Printf("[segment] remuxing seg=%d start=%.3fs dur=%.3fs\n", segNum, startTime, duration)
+		err := RemuxSegment(ctx, video.Path, outputPath, video.VideoStream, startTime, duration)
+		if err == nil || ctx.Err() != nil {
+			return remuxSignature, err
 		}
+		fmt.Printf("[segment] remux failed seg=%d, falling back to transcode: %v\n", segNum, err)
+	}
+
+	// Generate segment with CRF (software) or bitrate (hardware on RPI)
+	params := encodeParams(video, idx, rendition, burn)
+	if burn != nil {
+		if err := prepareBurnFile(ctx, video, burn); err != nil {
+			return "", fmt.Errorf("subtitles %s: %w", burn.ID, err)
+		}
+	}
+	fmt.Printf("[segment] generating seg=%d start=%.3fs dur=%.3fs crf=%d bitrate=%dk size=%dx%d\n", segNum, startTime, duration, params.CRF, params.BitrateKbps, params.Width, params.Height)
+	return params.Signature(), GenerateSegmentV4(ctx, video.Path, outputPath, startTime, duration, params)
+}
 
-		startTime := nextSeg * segmentDuration
-		fmt.Printf("[prefetch] generating seg=%d start=%ds\n", nextSeg, startTime)
+// prefetchSegments queues the next N segments with prefetch priority,
+// so they never delay a segment a viewer is waiting for.
+func prefetchSegments(video *VideoData, idx *KeyframeIndex, rendition *Rendition, burn *SubtitleRendition, currentSeg, count int) {
+	for i := 1; i <= count; i++ {
+		nextSeg := currentSeg + i
+		if nextSeg >= idx.NumSegments() {
+			break
+		}
 
-		if err := GenerateSegmentV4(context.Background(), video.Path, segmentPath, startTime, segmentDuration, crf, bitrateMbps); err != nil {
-			fmt.Printf("[prefetch] error seg=%d: %v\n", nextSeg, err)
+		if segmentCached(video, idx, rendition, burn, nextSeg) {
+			continue
 		}
-		lock.Unlock()
+		key, run := segmentJob(video, idx, rendition, burn, nextSeg)
+		transcoder.Submit(key, PriorityPrefetch, run)
 	}
 }
@@ -0,0 +1,357 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A video ID is assigned once and never derived from the content again, so
+// links, rooms and watch history survive renames and moves. The content is
+// tracked separately by the fingerprint: files with the same fingerprint are
+// duplicates, a file whose fingerprint changed was replaced.
+
+const removedKeep = 10 * time.Minute // how long a removed video can still be claimed by a move
+
+// removedVideos are videos dropped by the watcher that may reappear under
+// another path: a rename is seen as a removal followed by a new file.
+var (
+	removedVideos   []removedVideo
+	removedVideosMu sync.Mutex
+)
+
+type removedVideo struct {
+	video VideoData
+	at    time.Time
+}
+
+func newVideoID() string {
+	return randomID(8)
+}
+
+// fileFingerprint identifies the content of a file: head and tail hash plus
+// the exact size, so a remux that keeps both ends still changes it.
+func fileFingerprint(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	hash, err := fileHashHeadTail(path, 1)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%x", hash, info.Size()), nil
+}
+
+// resolveIdentities gives every scanned file (ID not set yet) the ID it
+// already had: first by path, then as a merged copy of another video, then
+// by fingerprint for videos whose path is gone (moved or renamed). Anything
+// else gets a new ID. Copies merged into another video are not returned.
+// present reports whether a path exists on disk.
+func resolveIdentities(existing, scanned []VideoData, present func(string) bool) []VideoData {
+	byPath := make(map[string]VideoData, len(existing))
+	byFingerprint := make(map[string][]VideoData)
+	owners := make(map[string]VideoData) // merged copy path -> video
+	for _, e := range existing {
+		byPath[e.Path] = e
+		if e.Fingerprint != "" {
+			byFingerprint[e.Fingerprint] = append(byFingerprint[e.Fingerprint], e)
+		}
+		for _, p := range e.AltPaths {
+			owners[p] = e
+		}
+	}
+
+	claimed := make(map[string]bool)
+	var result, pending []VideoData
+	for _, s := range scanned {
+		if e, ok := byPath[s.Path]; ok && !claimed[e.ID] {
+			claimed[e.ID] = true
+			result = append(result, adoptIdentity(e, s, present))
+			continue
+		}
+		pending = append(pending, s)
+	}
+
+next:
+	for _, s := range pending {
+		if e, ok := owners[s.Path]; ok {
+			if claimed[e.ID] || present(e.Path) {
+				continue // still a merged copy
+			}
+			// The listed copy is gone: this one takes its place
+			claimed[e.ID] = true
+			fmt.Printf("[data] %s now served from %s\n", e.ID, s.Path)
+			result = append(result, adoptIdentity(e, s, present))
+			continue
+		}
+		for _, e := range byFingerprint[s.Fingerprint] {
+			if !claimed[e.ID] && !present(e.Path) {
+				claimed[e.ID] = true
+				fmt.Printf("[data] moved: %s -> %s\n", e.Path, s.Path)
+				result = append(result, adoptIdentity(e, s, present))
+				continue next
+			}
+		}
+		s.ID = newVideoID()
+		result = append(result, s)
+	}
+	return result
+}
+
+// adoptIdentity gives the scanned file s the identity of the known video e.
+// If the content changed everything derived from the old one is dropped.
+func adoptIdentity(e, s VideoData, present func(string) bool) VideoData {
+	s.ID = e.ID
+	s.Aliases = e.Aliases
+	s.SubtitleOffsets = e.SubtitleOffsets
+	s.AltPaths = nil
+	for _, p := range e.AltPaths {
+		if p != s.Path && present(p) {
+			s.AltPaths = append(s.AltPaths, p)
+		}
+	}
+	// An empty fingerprint comes from before fingerprints were recorded
+	if e.Fingerprint != "" && e.Fingerprint != s.Fingerprint {
+		fmt.Printf("[data] content changed: %s\n", s.Path)
+		invalidateVideo(e.ID)
+		removeThumbnails(e.Fingerprint)
+		removeTrickplay(e.Fingerprint)
+		removeSubtitles(e.Fingerprint)
+	}
+	return s
+}
+
+// invalidateVideo drops everything derived from the content of a video whose
+// file was replaced. An optimize job is queued again.
+func invalidateVideo(id string) {
+	if dropVideoArtifacts(id) {
+		QueueOptimize(id)
+	}
+}
+
+// dropVideoArtifacts removes keyframe index, cached segments and optimized
+// package of a video. Reports whether it had an optimize job.
+func dropVideoArtifacts(id string) bool {
+	forgetKeyframeIndex(id)
+	if segCache != nil {
+		segCache.RemoveDir(filepath.Join(segmentsDir, id))
+	}
+	return RemoveOptimize(id)
+}
+
+// rememberRemoved keeps removed videos claimable by a later move.
+func rememberRemoved(videos []VideoData) {
+	removedVideosMu.Lock()
+	defer removedVideosMu.Unlock()
+	now := time.Now()
+	for _, v := range videos {
+		removedVideos = append(removedVideos, removedVideo{video: v, at: now})
+	}
+}
+
+// recentlyRemoved returns the removed videos still claimable and drops the
+// expired ones.
+func recentlyRemoved() []VideoData {
+	removedVideosMu.Lock()
+	defer removedVideosMu.Unlock()
+
+	var videos []VideoData
+	kept := removedVideos[:0]
+	for _, r := range removedVideos {
+		if time.Since(r.at) < removedKeep {
+			kept = append(kept, r)
+			videos = append(videos, r.video)
+		}
+	}
+	removedVideos = kept
+	return videos
+}
+
+// forgetRemoved drops a removed video once its ID is in use again.
+func forgetRemoved(id string) {
+	removedVideosMu.Lock()
+	defer removedVideosMu.Unlock()
+	for i, r := range removedVideos {
+		if r.video.ID == id {
+			removedVideos = append(removedVideos[:i], removedVideos[i+1:]...)
+			return
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Duplicates returns the listed videos sharing their content with another
+// one, grouped by fingerprint. Copies already merged are not included.
+func Duplicates() [][]VideoData {
+	groups := make(map[string][]VideoData)
+	for _, v := range GetVideos() {
+		if v.Fingerprint != "" {
+			groups[v.Fingerprint] = append(groups[v.Fingerprint], v)
+		}
+	}
+
+	var dups [][]VideoData
+	for _, g := range groups {
+		if len(g) > 1 {
+			sort.Slice(g, func(i, j int) bool { return g[i].Path < g[j].Path })
+			dups = append(dups, g)
+		}
+	}
+	sort.Slice(dups, func(i, j int) bool { return dups[i][0].Path < dups[j][0].Path })
+	return dups
+}
+
+// MergeVideos folds video from into video into: from's paths become merged
+// copies of into and from's ID (with its aliases) keeps resolving to into.
+// Returns the merged video and the one that is no longer listed.
+func MergeVideos(into, from string) (VideoData, VideoData, error) {
+	cacheMu.Lock()
+	target, ok := videoIndex[into]
+	source, ok2 := videoIndex[from]
+	switch {
+	case !ok || !ok2:
+		cacheMu.Unlock()
+		return VideoData{}, VideoData{}, fmt.Errorf("video not found")
+	case target == source:
+		cacheMu.Unlock()
+		return VideoData{}, VideoData{}, fmt.Errorf("cannot merge a video into itself")
+	}
+	dst, src := videoCache[target], videoCache[source]
+
+	dst.AltPaths = append(append(append([]string(nil), dst.AltPaths...), src.Path), src.AltPaths...)
+	dst.Aliases = append(append(append([]string(nil), dst.Aliases...), src.ID), src.Aliases...)
+
+	result := make([]VideoData, 0, len(videoCache)-1)
+	for _, v := range videoCache {
+		switch v.ID {
+		case src.ID:
+			continue
+		case dst.ID:
+			v = dst
+		}
+		result = append(result, v)
+	}
+
+	saveChanges([]VideoData{dst}, []string{src.ID})
+	setVideoCacheLocked(result)
+	cacheMu.Unlock()
+
+	// Its ID now resolves to dst: nothing cached under it may be served
+	dropVideoArtifacts(src.ID)
+	fmt.Printf("[data] merged %s (%s) into %s\n", src.ID, src.Path, dst.ID)
+	return dst, src, nil
+}
+
+// SplitVideo turns a merged copy of a video back into a video of its own,
+// with a new ID.
+func SplitVideo(id, path string) (VideoData, error) {
+	v := GetVideoByID(id)
+	if v == nil {
+		return VideoData{}, fmt.Errorf("video not found")
+	}
+	if !containsString(v.AltPaths, path) {
+		return VideoData{}, fmt.Errorf("%s is not a merged copy of %s", path, id)
+	}
+	split, err := scanVideoFile(path)
+	if err != nil {
+		return VideoData{}, err
+	}
+	split.ID = newVideoID()
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	i, ok := videoIndex[id]
+	if !ok {
+		return VideoData{}, fmt.Errorf("video not found")
+	}
+	owner := videoCache[i]
+	var altPaths []string
+	for _, p := range owner.AltPaths {
+		if p != path {
+			altPaths = append(altPaths, p)
+		}
+	}
+	if len(altPaths) == len(owner.AltPaths) {
+		// Split or merged again meanwhile
+		return VideoData{}, fmt.Errorf("%s is not a merged copy of %s", path, id)
+	}
+	owner.AltPaths = altPaths
+
+	result := make([]VideoData, 0, len(videoCache)+1)
+	result = append(result, videoCache[:i]...)
+	result = append(result, owner)
+	result = append(result, videoCache[i+1:]...)
+	result = append(result, split)
+
+	saveChanges([]VideoData{owner, split}, nil)
+	setVideoCacheLocked(result)
+	fmt.Printf("[data] split %s from %s as %s\n", path, owner.ID, split.ID)
+	return split, nil
+}
+
+// GET /admin/duplicates
+func HandleDuplicates(c *gin.Context) {
+	dups := Duplicates()
+	if dups == nil {
+		dups = [][]VideoData{}
+	}
+	c.JSON(200, dups)
+}
+
+// POST /admin/videos/merge {"into": id, "from": id}
+func HandleMergeVideos(c *gin.Context) {
+	var req struct {
+		Into string `json:"into"`
+		From string `json:"from"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Into == "" || req.From == "" {
+		c.String(400, "into and from required")
+		return
+	}
+	v, gone, err := MergeVideos(req.Into, req.From)
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	publishLibraryEvent(LibraryEvent{Type: "removed", ID: gone.ID, Path: gone.Path, Name: gone.Name})
+	publishLibraryEvent(LibraryEvent{Type: "updated", ID: v.ID, Path: v.Path, Name: v.Name})
+	c.JSON(200, v)
+}
+
+// POST /admin/videos/:id/split {"path": path}
+func HandleSplitVideo(c *gin.Context) {
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Path == "" {
+		c.String(400, "path required")
+		return
+	}
+	v, err := SplitVideo(c.Param("id"), filepath.Clean(req.Path))
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	publishLibraryEvent(LibraryEvent{Type: "added", ID: v.ID, Path: v.Path, Name: v.Name})
+	c.JSON(200, v)
+}
@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResolveIdentities(t *testing.T) {
+	existing := []VideoData{
+		{ID: "same", Path: "/video/same.mkv", Fingerprint: "fp-same", Aliases: []string{"old-same"},
+			SubtitleOffsets: map[string]float64{"0": 1}},
+		{ID: "moved", Path: "/video/old/moved.mkv", Fingerprint: "fp-moved"},
+		{ID: "original", Path: "/video/original.mkv", Fingerprint: "fp-dup"},
+		{ID: "owner", Path: "/video/owner.mkv", Fingerprint: "fp-owner",
+			AltPaths: []string{"/video/copy-kept.mkv", "/video/copy-gone.mkv"}},
+		{ID: "lost", Path: "/video/lost.mkv", Fingerprint: "fp-lost", AltPaths: []string{"/video/lost-copy.mkv"}},
+		{ID: "twice", Path: "/video/twice.mkv", Fingerprint: "fp-twice"},
+	}
+	onDisk := map[string]bool{
+		"/video/same.mkv": true, "/video/new/moved.mkv": true, "/video/original.mkv": true,
+		"/video/original-copy.mkv": true, "/video/owner.mkv": true, "/video/copy-kept.mkv": true,
+		"/video/lost-copy.mkv": true, "/video/twice-a.mkv": true, "/video/twice-b.mkv": true,
+	}
+	scanned := []VideoData{
+		{Path: "/video/same.mkv", Fingerprint: "fp-same"},
+		{Path: "/video/new/moved.mkv", Fingerprint: "fp-moved"},
+		{Path: "/video/original.mkv", Fingerprint: "fp-dup"},
+		{Path: "/video/original-copy.mkv", Fingerprint: "fp-dup"},
+		{Path: "/video/owner.mkv", Fingerprint: "fp-owner"},
+		{Path: "/video/copy-kept.mkv", Fingerprint: "fp-owner"},
+		{Path: "/video/lost-copy.mkv", Fingerprint: "fp-lost"},
+		{Path: "/video/twice-a.mkv", Fingerprint: "fp-twice"},
+		{Path: "/video/twice-b.mkv", Fingerprint: "fp-twice"},
+	}
+	got := resolveIdentities(existing, scanned, func(p string) bool { return onDisk[p] })
+
+	byPath := make(map[string]VideoData)
+	for _, v := range got {
+		byPath[v.Path] = v
+	}
+	known := make(map[string]bool)
+	for _, e := range existing {
+		known[e.ID] = true
+	}
+	tests := []struct {
+		path, id string // empty id: a new one
+		why      string
+	}{
+		{"/video/same.mkv", "same", "same path"},
+		{"/video/new/moved.mkv", "moved", "moved: same content, old path gone"},
+		{"/video/original.mkv", "original", "same path"},
+		{"/video/original-copy.mkv", "", "a copy of a file still there is a duplicate"},
+		{"/video/owner.mkv", "owner", "same path"},
+		{"/video/lost-copy.mkv", "lost", "the merged copy takes the place of the gone file"},
+		{"/video/twice-a.mkv", "twice", "the first file with the content of a gone one claims it"},
+		{"/video/twice-b.mkv", "", "the ID is claimed once"},
+	}
+	for _, tt := range tests {
+		v, ok := byPath[tt.path]
+		switch {
+		case !ok:
+			t.Errorf("%s not resolved", tt.path)
+		case tt.id != "" && v.ID != tt.id:
+			t.Errorf("%s: ID %q, want %q (%s)", tt.path, v.ID, tt.id, tt.why)
+		case tt.id == "" && (v.ID == "" || known[v.ID]):
+			t.Errorf("%s: ID %q, want a new one (%s)", tt.path, v.ID, tt.why)
+		}
+	}
+	if _, ok := byPath["/video/copy-kept.mkv"]; ok {
+		t.Error("merged copy listed as a video of its own")
+	}
+	if len(got) != len(tests) {
+		t.Errorf("%d videos resolved, want %d", len(got), len(tests))
+	}
+
+	// What belongs to the identity goes with it; copies no longer on disk are dropped
+	same := byPath["/video/same.mkv"]
+	if !reflect.DeepEqual(same.Aliases, []string{"old-same"}) || same.SubtitleOffsets["0"] != 1 {
+		t.Errorf("same: aliases %v offsets %v not kept", same.Aliases, same.SubtitleOffsets)
+	}
+	if owner := byPath["/video/owner.mkv"]; !reflect.DeepEqual(owner.AltPaths, []string{"/video/copy-kept.mkv"}) {
+		t.Errorf("owner copies = %v, want only the one on disk", owner.AltPaths)
+	}
+}
+
+func TestResolveIdentitiesContentChanged(t *testing.T) {
+	existing := []VideoData{{ID: "keep", Path: "/video/a.mkv", Fingerprint: "fp-before-test"}}
+	scanned := []VideoData{{Path: "/video/a.mkv", Fingerprint: "fp-after-test"}}
+	got := resolveIdentities(existing, scanned, func(string) bool { return true })
+	if len(got) != 1 || got[0].ID != "keep" || got[0].Fingerprint != "fp-after-test" {
+		t.Errorf("replaced file = %+v, want the same ID with the new fingerprint", got)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	withLibrary(t, []VideoData{
+		{ID: "b2", Path: "/video/b/2.mkv", Fingerprint: "fp-b"},
+		{ID: "a1", Path: "/video/a/1.mkv", Fingerprint: "fp-a"},
+		{ID: "b1", Path: "/video/b/1.mkv", Fingerprint: "fp-b"},
+		{ID: "a2", Path: "/video/a/2.mkv", Fingerprint: "fp-a"},
+		{ID: "single", Path: "/video/single.mkv", Fingerprint: "fp-single"},
+		{ID: "legacy1", Path: "/video/legacy1.mkv"},
+		{ID: "legacy2", Path: "/video/legacy2.mkv"},
+	})
+	var got [][]string
+	for _, g := range Duplicates() {
+		var ids []string
+		for _, v := range g {
+			ids = append(ids, v.ID)
+		}
+		got = append(got, ids)
+	}
+	want := [][]string{{"a1", "a2"}, {"b1", "b2"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Duplicates() = %v, want %v", got, want)
+	}
+}
+
+func TestMergeVideos(t *testing.T) {
+	withAuthStore(t)
+	withLibrary(t, []VideoData{
+		{ID: "into", Path: "/video/into.mkv", Fingerprint: "fp", Aliases: []string{"into-old"}},
+		{ID: "from", Path: "/video/from.mkv", Fingerprint: "fp", Aliases: []string{"from-old"},
+			AltPaths: []string{"/video/from-copy.mkv"}},
+	})
+	progress["1"] = map[string]WatchProgress{"from": {UserID: "1", VideoID: "from", Position: 42}}
+
+	if _, _, err := MergeVideos("into", "into"); err == nil {
+		t.Error("merging a video into itself succeeded")
+	}
+	if _, _, err := MergeVideos("into", "unknown"); err == nil {
+		t.Error("merging an unknown video succeeded")
+	}
+
+	merged, gone, err := MergeVideos("into", "from")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gone.ID != "from" {
+		t.Errorf("gone = %s, want from", gone.ID)
+	}
+	if want := []string{"/video/from.mkv", "/video/from-copy.mkv"}; !reflect.DeepEqual(merged.AltPaths, want) {
+		t.Errorf("copies = %v, want %v", merged.AltPaths, want)
+	}
+	if want := []string{"into-old", "from", "from-old"}; !reflect.DeepEqual(merged.Aliases, want) {
+		t.Errorf("aliases = %v, want %v", merged.Aliases, want)
+	}
+
+	// Old links keep working
+	for _, id := range []string{"into", "from", "from-old"} {
+		if v := GetVideoByID(id); v == nil || v.ID != "into" {
+			t.Errorf("GetVideoByID(%q) = %v, want into", id, v)
+		}
+	}
+	if n := len(GetVideos()); n != 1 {
+		t.Errorf("%d videos listed, want 1", n)
+	}
+	if stored, err := library.Videos(); err != nil || len(stored) != 1 || !reflect.DeepEqual(stored[0], merged) {
+		t.Errorf("stored = %+v, %v; want only the merged video", stored, err)
+	}
+
+	// Progress recorded before the merge is found, then moves to the new ID
+	video := GetVideoByID("into")
+	if p, ok := GetProgress("1", video); !ok || p.Position != 42 {
+		t.Fatalf("progress after merge = %+v, %v; want position 42", p, ok)
+	}
+	if _, err := updateProgress("1", video, func(p *WatchProgress) { p.Position += 10 }); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := progress["1"]["from"]; ok {
+		t.Error("progress still under the merged ID")
+	}
+	if p := progress["1"]["into"]; p.Position != 52 || p.VideoID != "into" {
+		t.Errorf("progress = %+v, want position 52 on into", p)
+	}
+	stored, err := library.Progress()
+	if err != nil || len(stored) != 1 || stored[0].VideoID != "into" {
+		t.Errorf("stored progress = %+v, %v; want one entry on into", stored, err)
+	}
+}
+
+func TestSplitVideo(t *testing.T) {
+	withAuthStore(t)
+	dir := t.TempDir()
+	copyPath := filepath.Join(dir, "copy.mkv")
+	if err := os.WriteFile(copyPath, []byte("same content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	withLibrary(t, []VideoData{
+		{ID: "owner", Path: filepath.Join(dir, "owner.mkv"), Aliases: []string{"merged"},
+			AltPaths: []string{copyPath, filepath.Join(dir, "other.mkv")}},
+	})
+
+	if _, err := SplitVideo("owner", filepath.Join(dir, "unrelated.mkv")); err == nil {
+		t.Error("split of a path that is not a copy succeeded")
+	}
+
+	split, err := SplitVideo("owner", copyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if split.ID == "" || split.ID == "owner" || split.ID == "merged" || split.Path != copyPath || split.Fingerprint == "" {
+		t.Errorf("split = %+v, want a new video at the copy", split)
+	}
+	owner := GetVideoByID("owner")
+	if !reflect.DeepEqual(owner.AltPaths, []string{filepath.Join(dir, "other.mkv")}) {
+		t.Errorf("owner copies = %v, want the split one gone", owner.AltPaths)
+	}
+	if !reflect.DeepEqual(owner.Aliases, []string{"merged"}) {
+		t.Errorf("owner aliases = %v, want them kept", owner.Aliases)
+	}
+	if v := GetVideoByID(split.ID); v == nil || v.Path != copyPath {
+		t.Errorf("split video not listed: %v", v)
+	}
+	if stored, ok, err := library.VideoByPath(copyPath); err != nil || !ok || stored.ID != split.ID {
+		t.Errorf("stored split = %+v, %v, %v", stored, ok, err)
+	}
+	if _, err := SplitVideo("owner", copyPath); err == nil {
+		t.Error("second split of the same copy succeeded")
+	}
+}
+
+func TestWatcherRenameKeepsID(t *testing.T) {
+	withAuthStore(t)
+	dir := t.TempDir()
+	oldPath, newPath := filepath.Join(dir, "old.mkv"), filepath.Join(dir, "new.mkv")
+	if err := os.WriteFile(oldPath, []byte("movie"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fp, err := fileFingerprint(oldPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withLibrary(t, []VideoData{{ID: "keep", Path: oldPath, Fingerprint: fp}})
+
+	// A rename reaches the watcher as a removal, then a new file
+	if err := os.Rename(oldPath, newPath); err != nil {
+		t.Fatal(err)
+	}
+	if removed := RemoveVideoPath(oldPath); len(removed) != 1 || removed[0].ID != "keep" {
+		t.Fatalf("RemoveVideoPath = %+v", removed)
+	}
+	v, _, err := UpsertVideoFile(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.ID != "keep" || v.Path != newPath {
+		t.Errorf("renamed video = %s at %s, want keep at %s", v.ID, v.Path, newPath)
+	}
+	for _, r := range recentlyRemoved() {
+		if r.ID == "keep" {
+			t.Error("renamed video still claimable as removed")
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package internal
+
+import "os"
+
+// fileInode is not available on this platform: size and mtime only.
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
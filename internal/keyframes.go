@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const keyframesDir = "/data/keyframes"
+
+// keyframeIndexVersion is bumped when the way indexes are built changes;
+// indexes saved by an older version are probed again.
+const keyframeIndexVersion = 2
+
+// KeyframeIndex holds the timing of a video: its frame rate, the source
+// keyframes and the segment boundaries derived from them.
+// It is probed once per video and cached in /data/keyframes/:id.json.
+type KeyframeIndex struct {
+	Version     int       `json:"version"`
+	VideoStream int       `json:"video_stream"` // stream the keyframes were read from
+	FrameRate   float64   `json:"frame_rate"`
+	Keyframes   []float64 `json:"keyframes"`  // source keyframe times, seconds from start
+	Boundaries  []float64 `json:"boundaries"` // segment i spans Boundaries[i]..Boundaries[i+1]
+}
+
+// NumSegments returns how many segments the video is split into.
+func (k *KeyframeIndex) NumSegments() int {
+	return len(k.Boundaries) - 1
+}
+
+// Segment returns start and duration of segment n.
+func (k *KeyframeIndex) Segment(n int) (float64, float64) {
+	return k.Boundaries[n], k.Boundaries[n+1] - k.Boundaries[n]
+}
+
+// MaxSegmentDuration returns the longest segment, for #EXT-X-TARGETDURATION.
+func (k *KeyframeIndex) MaxSegmentDuration() float64 {
+	longest := 0.0
+	for i := 0; i < k.NumSegments(); i++ {
+		_, d := k.Segment(i)
+		longest = max(longest, d)
+	}
+	return longest
+}
+
+// KeyframeAligned reports whether every boundary falls on a source keyframe,
+// i.e. segments can be cut without re-encoding.
+func (k *KeyframeIndex) KeyframeAligned() bool {
+	if len(k.Keyframes) == 0 {
+		return false
+	}
+	tolerance := frameTolerance(k.FrameRate)
+	j := 0
+	for _, b := range k.Boundaries[:len(k.Boundaries)-1] {
+		for j < len(k.Keyframes) && k.Keyframes[j] < b-tolerance {
+			j++
+		}
+		if j == len(k.Keyframes) || math.Abs(k.Keyframes[j]-b) > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	keyframeCache   = make(map[string]*KeyframeIndex)
+	keyframeCacheMu sync.Mutex
+)
+
+// GetKeyframeIndex returns the timing index of a video, probing it on first use.
+// If the probe fails a fixed-duration index is used instead; it is kept in
+// memory only, so the probe is tried again after a restart.
+// An index read from another video stream (the re-probe picked a different
+// one) or saved by an older version is probed again.
+func GetKeyframeIndex(video *VideoData) *KeyframeIndex {
+	// Probing a long file takes a while: hold the lock of this video only
+	lock := getSegmentLock("keyframes_" + video.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	keyframeCacheMu.Lock()
+	idx, ok := keyframeCache[video.ID]
+	keyframeCacheMu.Unlock()
+	if ok && idx.matches(video) {
+		return idx
+	}
+
+	idx = loadKeyframeIndex(video.ID)
+	if idx != nil && !idx.matches(video) {
+		idx = nil
+	}
+	if idx == nil {
+		probed, err := probeKeyframeIndex(video)
+		if err != nil {
+			fmt.Printf("[keyframes] probe failed for %s: %v\n", video.Path, err)
+			idx = fixedKeyframeIndex(video.Duration, video.FrameRate)
+			idx.Version, idx.VideoStream = keyframeIndexVersion, video.VideoStream
+		} else {
+			idx = probed
+			if err := saveKeyframeIndex(video.ID, idx); err != nil {
+				fmt.Printf("[keyframes] error saving %s: %v\n", video.ID, err)
+			}
+		}
+	}
+
+	keyframeCacheMu.Lock()
+	keyframeCache[video.ID] = idx
+	keyframeCacheMu.Unlock()
+	return idx
+}
+
+// matches reports whether the index was built for the current probe of video.
+func (k *KeyframeIndex) matches(video *VideoData) bool {
+	return k.Version == keyframeIndexVersion && k.VideoStream == video.VideoStream
+}
+
+// forgetKeyframeIndex drops the index of a video, in memory and on disk.
+func forgetKeyframeIndex(id string) {
+	keyframeCacheMu.Lock()
+	delete(keyframeCache, id)
+	keyframeCacheMu.Unlock()
+	os.Remove(filepath.Join(keyframesDir, id+".json"))
+}
+
+func loadKeyframeIndex(id string) *KeyframeIndex {
+	data, err := os.ReadFile(filepath.Join(keyframesDir, id+".json"))
+	if err != nil {
+		return nil
+	}
+	var idx KeyframeIndex
+	if err := json.Unmarshal(data, &idx); err != nil || len(idx.Boundaries) < 2 {
+		return nil
+	}
+	return &idx
+}
+
+func saveKeyframeIndex(id string, idx *KeyframeIndex) error {
+	if err := os.MkdirAll(keyframesDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(keyframesDir, id+".json"), data, 0644)
+}
+
+// probeKeyframeIndex reads the keyframe times of the video stream;
+// frame rate and start time come from the library probe.
+// Only packets are read (no decoding), so it is fast even on the Pi.
+func probeKeyframeIndex(video *VideoData) (*KeyframeIndex, error) {
+	if video.VideoCodec == "" {
+		return nil, fmt.Errorf("no video stream")
+	}
+	fps := video.FrameRate
+
+	cmd := exec.Command("ffprobe",
+		"-v", "error",
+		"-select_streams", strconv.Itoa(video.VideoStream),
+		"-show_entries", "packet=pts_time,flags",
+		"-of", "csv=p=0",
+		video.Path,
+	)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var keyframes []float64
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		// Lines look like "12.345000,K__"
+		parts := strings.Split(strings.TrimSpace(scanner.Text()), ",")
+		if len(parts) < 2 || !strings.HasPrefix(parts[1], "K") {
+			continue
+		}
+		t, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			continue
+		}
+		keyframes = append(keyframes, max(0, t-video.StartTime))
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+
+	// Packets come in decode order: sort by time
+	slices.Sort(keyframes)
+	fmt.Printf("[keyframes] path=%s fps=%.3f keyframes=%d\n", video.Path, fps, len(keyframes))
+
+	idx := keyframeAlignedIndex(video.Duration, fps, keyframes)
+	if idx == nil {
+		// Keyframes too sparse to cut on: fixed grid, the encoders create their own
+		idx = fixedKeyframeIndex(video.Duration, fps)
+	}
+	idx.Version, idx.VideoStream = keyframeIndexVersion, video.VideoStream
+	idx.Keyframes = keyframes
+	return idx, nil
+}
+
+// parseRational parses ffprobe rates like "30000/1001".
+func parseRational(s string) float64 {
+	num, den, found := strings.Cut(s, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// keyframeAlignedIndex cuts a segment at the first keyframe after every
+// segmentDuration seconds. Returns nil if keyframes are too far apart for that.
+func keyframeAlignedIndex(duration, fps float64, keyframes []float64) *KeyframeIndex {
+	if len(keyframes) < 2 || duration <= 0 {
+		return nil
+	}
+	maxGap := 0.0
+	for i := 1; i < len(keyframes); i++ {
+		maxGap = max(maxGap, keyframes[i]-keyframes[i-1])
+	}
+	if maxGap > 2*segmentDuration {
+		return nil
+	}
+
+	tolerance := frameTolerance(fps)
+	boundaries := []float64{0}
+	for _, kf := range keyframes {
+		if kf >= boundaries[len(boundaries)-1]+segmentDuration-tolerance && kf < duration-tolerance {
+			boundaries = append(boundaries, kf)
+		}
+	}
+	return &KeyframeIndex{FrameRate: fps, Boundaries: closeBoundaries(boundaries, duration)}
+}
+
+// fixedKeyframeIndex splits the video every segmentDuration seconds, rounded
+// to whole frames so that forced keyframes land exactly on a frame.
+func fixedKeyframeIndex(duration, fps float64) *KeyframeIndex {
+	boundaries := []float64{0}
+	for t := float64(segmentDuration); t < duration; t += segmentDuration {
+		b := t
+		if fps > 0 {
+			b = math.Round(t*fps) / fps
+		}
+		boundaries = append(boundaries, b)
+	}
+	return &KeyframeIndex{FrameRate: fps, Boundaries: closeBoundaries(boundaries, duration)}
+}
+
+// closeBoundaries appends the end of the video, merging a last segment too
+// short to be worth its own request into the previous one.
+func closeBoundaries(boundaries []float64, duration float64) []float64 {
+	if len(boundaries) > 1 && duration-boundaries[len(boundaries)-1] < 0.5 {
+		boundaries = boundaries[:len(boundaries)-1]
+	}
+	return append(boundaries, max(duration, boundaries[len(boundaries)-1]+0.001))
+}
+
+// frameTolerance is half a frame: enough to absorb rounding in probed timestamps.
+func frameTolerance(fps float64) float64 {
+	if fps <= 0 {
+		return 0.001
+	}
+	return 0.5 / fps
+}
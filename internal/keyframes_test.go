@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseRational(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+	}{
+		{"25/1", 25},
+		{"30000/1001", 30000.0 / 1001},
+		{"24", 24},
+		{"0/0", 0},
+		{"1/x", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRational(tt.in); got != tt.want {
+			t.Errorf("parseRational(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFixedKeyframeIndex(t *testing.T) {
+	tests := []struct {
+		duration, fps float64
+		want          []float64
+	}{
+		{10, 0, []float64{0, 4, 8, 10}},
+		{8.3, 0, []float64{0, 4, 8.3}}, // short tail merged into the last segment
+		{3, 0, []float64{0, 3}},
+		{0, 0, []float64{0, 0.001}},
+		{10, 30000.0 / 1001, []float64{0, 120 / (30000.0 / 1001), 240 / (30000.0 / 1001), 10}},
+	}
+	for _, tt := range tests {
+		got := fixedKeyframeIndex(tt.duration, tt.fps).Boundaries
+		if len(got) != len(tt.want) {
+			t.Errorf("fixedKeyframeIndex(%v, %v) = %v, want %v", tt.duration, tt.fps, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if math.Abs(got[i]-tt.want[i]) > 1e-9 {
+				t.Errorf("fixedKeyframeIndex(%v, %v) = %v, want %v", tt.duration, tt.fps, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestKeyframeAlignedIndex(t *testing.T) {
+	every2s := []float64{0, 2, 4, 6, 8, 10, 12, 14, 16, 18}
+	tests := []struct {
+		name      string
+		duration  float64
+		keyframes []float64
+		want      []float64 // nil: not alignable
+	}{
+		{"regular GOP", 20, every2s, []float64{0, 4, 8, 12, 16, 20}},
+		{"irregular GOP", 12, []float64{0, 3, 5, 7.5, 9, 11.8}, []float64{0, 5, 9, 12}},
+		{"sparse keyframes", 30, []float64{0, 10, 20}, nil},
+		{"single keyframe", 30, []float64{0}, nil},
+		{"unknown duration", 0, every2s, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx := keyframeAlignedIndex(tt.duration, 25, tt.keyframes)
+			if tt.want == nil {
+				if idx != nil {
+					t.Fatalf("got %v, want nil", idx.Boundaries)
+				}
+				return
+			}
+			if idx == nil || !reflect.DeepEqual(idx.Boundaries, tt.want) {
+				t.Fatalf("got %v, want %v", idx, tt.want)
+			}
+			idx.Keyframes = tt.keyframes
+			if !idx.KeyframeAligned() {
+				t.Error("KeyframeAligned() = false for an index cut on keyframes")
+			}
+		})
+	}
+}
+
+func TestKeyframeAligned(t *testing.T) {
+	idx := fixedKeyframeIndex(12, 25)
+	if idx.KeyframeAligned() {
+		t.Error("index without keyframes reported aligned")
+	}
+	idx.Keyframes = []float64{0, 4.04, 8}
+	if idx.KeyframeAligned() {
+		t.Error("boundary off a keyframe by a frame reported aligned")
+	}
+	idx.Keyframes = []float64{0, 2, 4.001, 6, 8}
+	if !idx.KeyframeAligned() {
+		t.Error("boundaries within half a frame of keyframes reported unaligned")
+	}
+}
+
+func TestGetKeyframeIndexStale(t *testing.T) {
+	// No video codec: the probe fails without running ffprobe
+	video := &VideoData{ID: "stale-test", MediaInfo: MediaInfo{Duration: 10, VideoStream: 1}}
+	tests := []struct {
+		name   string
+		cached KeyframeIndex
+	}{
+		{"other stream", KeyframeIndex{Version: keyframeIndexVersion, VideoStream: 0, Boundaries: []float64{0, 10}}},
+		{"old version", KeyframeIndex{VideoStream: 1, Boundaries: []float64{0, 10}}},
+	}
+	for _, tt := range tests {
+		keyframeCacheMu.Lock()
+		keyframeCache[video.ID] = &tt.cached
+		keyframeCacheMu.Unlock()
+
+		idx := GetKeyframeIndex(video)
+		if idx == &tt.cached {
+			t.Errorf("%s: stale index reused", tt.name)
+		}
+		if !idx.matches(video) || idx.NumSegments() != 3 {
+			t.Errorf("%s: got %+v, want the fixed index of stream 1", tt.name, idx)
+		}
+	}
+	keyframeCacheMu.Lock()
+	delete(keyframeCache, video.ID)
+	keyframeCacheMu.Unlock()
+}
@@ -0,0 +1,365 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Optimized videos are fully pre-transcoded HLS packages kept in /data, so
+// they survive restarts and are preferred over the /tmp segment cache.
+const (
+	optimizedDir      = "/data/optimized"
+	optimizeStateFile = "/data/optimize.json"
+)
+
+// OptimizeJob is the persisted progress of a pre-transcode.
+type OptimizeJob struct {
+	VideoID   string    `json:"video_id"`
+	Status    string    `json:"status"` // queued, running, paused, done, failed
+	Done      int       `json:"done"`
+	Total     int       `json:"total"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var optimizer = struct {
+	mu      sync.Mutex
+	loaded  bool // jobs read from optimizeStateFile
+	jobs    []*OptimizeJob
+	cancels map[string]context.CancelFunc // running job by video ID
+	wake    chan struct{}
+}{
+	cancels: make(map[string]context.CancelFunc),
+	wake:    make(chan struct{}, 1),
+}
+
+func optimizedSegmentFile(id string, segNum int) string {
+	return filepath.Join(optimizedDir, id, fmt.Sprintf("segment_%d.ts", segNum))
+}
+
+func optimizedPlaylistFile(id string) string {
+	return filepath.Join(optimizedDir, id, "playlist.m3u8")
+}
+
+// optimizedComplete reports whether a video has a finished package. The
+// playlist is written last, so its presence means every segment is there.
+func optimizedComplete(id string) bool {
+	_, err := os.Stat(optimizedPlaylistFile(id))
+	return err == nil
+}
+
+// StartOptimizer resumes the pre-transcodes left unfinished by a previous run
+// and processes new ones within the window set by GAZEPARTY_OPTIMIZE_WINDOW
+// ("01:00-06:00", empty = any time) while nobody is watching.
+func StartOptimizer() {
+	optimizer.mu.Lock()
+	loadOptimizeStateLocked()
+	optimizer.mu.Unlock()
+
+	go optimizeLoop()
+	fmt.Printf("[optimize] started: window=%q pending=%d\n", os.Getenv("GAZEPARTY_OPTIMIZE_WINDOW"), len(pendingOptimizeJobs()))
+}
+
+// QueueOptimize adds a video to the pre-transcode queue.
+func QueueOptimize(id string) *OptimizeJob {
+	optimizer.mu.Lock()
+	defer optimizer.mu.Unlock()
+	loadOptimizeStateLocked()
+
+	job := findOptimizeJobLocked(id)
+	if job == nil {
+		job = &OptimizeJob{VideoID: id}
+		optimizer.jobs = append(optimizer.jobs, job)
+	}
+	if job.Status != "done" || !optimizedComplete(id) {
+		job.Status = "queued"
+		job.Error = ""
+	}
+	job.UpdatedAt = time.Now()
+	saveOptimizeStateLocked()
+
+	select {
+	case optimizer.wake <- struct{}{}:
+	default:
+	}
+	return job
+}
+
+// RemoveOptimize stops a pre-transcode and deletes its package.
+func RemoveOptimize(id string) bool {
+	optimizer.mu.Lock()
+	defer optimizer.mu.Unlock()
+	loadOptimizeStateLocked()
+
+	if cancel, ok := optimizer.cancels[id]; ok {
+		cancel()
+	}
+	found := false
+	for i, job := range optimizer.jobs {
+		if job.VideoID == id {
+			optimizer.jobs = append(optimizer.jobs[:i], optimizer.jobs[i+1:]...)
+			found = true
+			break
+		}
+	}
+	os.RemoveAll(filepath.Join(optimizedDir, id))
+	saveOptimizeStateLocked()
+	return found
+}
+
+func findOptimizeJobLocked(id string) *OptimizeJob {
+	for _, job := range optimizer.jobs {
+		if job.VideoID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+func pendingOptimizeJobs() []*OptimizeJob {
+	optimizer.mu.Lock()
+	defer optimizer.mu.Unlock()
+	loadOptimizeStateLocked()
+
+	var pending []*OptimizeJob
+	for _, job := range optimizer.jobs {
+		if job.Status == "queued" || job.Status == "paused" {
+			pending = append(pending, job)
+		}
+	}
+	return pending
+}
+
+func optimizeLoop() {
+	for {
+		pending := pendingOptimizeJobs()
+		if len(pending) == 0 || !optimizeAllowed(time.Now()) {
+			select {
+			case <-optimizer.wake:
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+		runOptimize(pending[0], false)
+	}
+}
+
+// optimizeAllowed reports whether background work may run now: inside the
+// configured window and with no viewer streaming.
+func optimizeAllowed(now time.Time) bool {
+	return inOptimizeWindow(os.Getenv("GAZEPARTY_OPTIMIZE_WINDOW"), now) && activeViewers() == 0
+}
+
+// inOptimizeWindow parses windows like "01:00-06:00", which may cross midnight.
+func inOptimizeWindow(window string, now time.Time) bool {
+	from, to, ok := strings.Cut(window, "-")
+	if !ok {
+		return true
+	}
+	start, err1 := time.Parse("15:04", strings.TrimSpace(from))
+	end, err2 := time.Parse("15:04", strings.TrimSpace(to))
+	if err1 != nil || err2 != nil {
+		fmt.Printf("[optimize] invalid window %q, ignoring\n", window)
+		return true
+	}
+
+	minutes := now.Hour()*60 + now.Minute()
+	s := start.Hour()*60 + start.Minute()
+	e := end.Hour()*60 + end.Minute()
+	if s <= e {
+		return minutes >= s && minutes < e
+	}
+	return minutes >= s || minutes < e
+}
+
+// runOptimize encodes every missing segment of a video into its package.
+// Segments already valid on disk are skipped, which is what makes it resumable.
+// Unless force is set it stops (as paused) when the window closes or a viewer starts.
+func runOptimize(job *OptimizeJob, force bool) error {
+	video := GetVideoByID(job.VideoID)
+	if video == nil {
+		return finishOptimize(job, fmt.Errorf("video not found"))
+	}
+	idx := GetKeyframeIndex(video)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	optimizer.mu.Lock()
+	optimizer.cancels[job.VideoID] = cancel
+	job.Status = "running"
+	job.Total = idx.NumSegments()
+	job.UpdatedAt = time.Now()
+	saveOptimizeStateLocked()
+	optimizer.mu.Unlock()
+
+	defer func() {
+		optimizer.mu.Lock()
+		delete(optimizer.cancels, job.VideoID)
+		optimizer.mu.Unlock()
+	}()
+
+	os.MkdirAll(filepath.Join(optimizedDir, video.ID), 0755)
+	fmt.Printf("[optimize] start video=%s segments=%d\n", video.Path, job.Total)
+
+	for n := 0; n < idx.NumSegments(); n++ {
+		if !force && !optimizeAllowed(time.Now()) {
+			optimizer.mu.Lock()
+			job.Status = "paused"
+			job.UpdatedAt = time.Now()
+			saveOptimizeStateLocked()
+			optimizer.mu.Unlock()
+			fmt.Printf("[optimize] paused video=%s at %d/%d\n", video.Path, job.Done, job.Total)
+			return nil
+		}
+
+		path := optimizedSegmentFile(video.ID, n)
+		if !segmentUpToDate(path, video, idx, nil, nil, n) {
+			key := JobKey{VideoID: video.ID, Rendition: "optimize", Segment: n}
+			err := transcoder.Run(ctx, key, PriorityBackground, func(ctx context.Context) error {
+				_, err := encodeSegment(ctx, video, idx, nil, nil, n, path)
+				return err
+			})
+			if ctx.Err() != nil {
+				// Removed while running
+				return ctx.Err()
+			}
+			if err != nil {
+				return finishOptimize(job, err)
+			}
+		}
+
+		optimizer.mu.Lock()
+		job.Done = n + 1
+		job.UpdatedAt = time.Now()
+		saveOptimizeStateLocked()
+		optimizer.mu.Unlock()
+	}
+
+	// The playlist marks the package as complete
+	if err := os.WriteFile(optimizedPlaylistFile(video.ID), []byte(mediaPlaylist(video)), 0644); err != nil {
+		return finishOptimize(job, err)
+	}
+	fmt.Printf("[optimize] done video=%s\n", video.Path)
+	return finishOptimize(job, nil)
+}
+
+func finishOptimize(job *OptimizeJob, err error) error {
+	optimizer.mu.Lock()
+	defer optimizer.mu.Unlock()
+
+	job.Status = "done"
+	job.Error = ""
+	if err != nil {
+		job.Status = "failed"
+		job.Error = err.Error()
+		fmt.Printf("[optimize] failed video=%s: %v\n", job.VideoID, err)
+	}
+	job.UpdatedAt = time.Now()
+	saveOptimizeStateLocked()
+	return err
+}
+
+// loadOptimizeStateLocked reads the queue left by the previous run, once.
+// Content changes found by the startup scan remove jobs before
+// StartOptimizer runs, so every access goes through here first.
+// optimizer.mu must be held.
+func loadOptimizeStateLocked() {
+	if optimizer.loaded {
+		return
+	}
+	optimizer.loaded = true
+	optimizer.jobs = loadOptimizeState()
+	// Nothing runs yet in a new process
+	for _, job := range optimizer.jobs {
+		if job.Status == "running" {
+			job.Status = "queued"
+		}
+	}
+}
+
+func loadOptimizeState() []*OptimizeJob {
+	data, err := os.ReadFile(optimizeStateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("[optimize] error reading state: %v\n", err)
+		}
+		return nil
+	}
+	var jobs []*OptimizeJob
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		fmt.Printf("[optimize] error parsing state: %v\n", err)
+		return nil
+	}
+	return jobs
+}
+
+// saveOptimizeStateLocked persists the queue. optimizer.mu must be held.
+// A queue that was never loaded is not saved, it would erase the file.
+func saveOptimizeStateLocked() {
+	if !optimizer.loaded {
+		return
+	}
+	data, err := json.MarshalIndent(optimizer.jobs, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(optimizeStateFile, data, 0644); err != nil {
+		fmt.Printf("[optimize] error saving state: %v\n", err)
+	}
+}
+
+// OptimizeNow pre-transcodes the given videos right away, ignoring the window.
+// Used by the "optimize" command line.
+func OptimizeNow(ids []string) error {
+	for _, id := range ids {
+		video := GetVideoByID(id)
+		if video == nil {
+			return fmt.Errorf("video not found: %s", id)
+		}
+		job := QueueOptimize(video.ID)
+		if err := runOptimize(job, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GET /admin/optimize
+func HandleOptimizeList(c *gin.Context) {
+	optimizer.mu.Lock()
+	defer optimizer.mu.Unlock()
+	loadOptimizeStateLocked()
+	c.JSON(200, optimizer.jobs)
+}
+
+// POST /admin/optimize/:id
+func HandleOptimizeQueue(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	job := QueueOptimize(video.ID)
+
+	optimizer.mu.Lock()
+	defer optimizer.mu.Unlock()
+	c.JSON(202, job)
+}
+
+// DELETE /admin/optimize/:id
+func HandleOptimizeRemove(c *gin.Context) {
+	if !RemoveOptimize(c.Param("id")) {
+		c.String(404, "not optimized")
+		return
+	}
+	c.Status(204)
+}
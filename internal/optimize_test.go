@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInOptimizeWindow(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		t, _ := time.Parse("15:04", hhmm)
+		return t
+	}
+	tests := []struct {
+		window string
+		now    string
+		want   bool
+	}{
+		{"", "12:00", true},
+		{"01:00-06:00", "00:59", false},
+		{"01:00-06:00", "01:00", true},
+		{"01:00-06:00", "05:59", true},
+		{"01:00-06:00", "06:00", false},
+		{"23:00-02:00", "23:30", true},
+		{"23:00-02:00", "01:59", true},
+		{"23:00-02:00", "02:00", false},
+		{"23:00-02:00", "12:00", false},
+		{" 01:00 - 06:00 ", "03:00", true},
+		{"00:00-00:00", "12:00", false}, // empty window
+		{"bogus", "12:00", true},
+		{"1am-6am", "12:00", true}, // invalid, ignored
+	}
+	for _, tt := range tests {
+		if got := inOptimizeWindow(tt.window, at(tt.now)); got != tt.want {
+			t.Errorf("inOptimizeWindow(%q, %s) = %v, want %v", tt.window, tt.now, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	prefetchCount = 2                // segments encoded ahead of a viewer
+	playheadTTL   = 90 * time.Second // a viewer silent for this long is gone
+
+	viewerHeader = "X-Gazeparty-Viewer" // random per player tab
+)
+
+// playhead is the last segment a viewer asked for.
+type playhead struct {
+	key  JobKey
+	seen time.Time
+}
+
+// playheads tracks every viewer's position, so prefetch work left behind by a
+// seek or a closed tab can be told apart from work someone is about to need.
+var (
+	playheads   = make(map[string]playhead)
+	playheadsMu sync.Mutex
+)
+
+// viewerID identifies a viewer well enough to follow its position: the
+// player tab within a login session. Players that can't send the tab ID
+// (native HLS) fall back to address and browser.
+func viewerID(c *gin.Context) string {
+	session := ""
+	if token, err := c.Cookie(sessionCookie); err == nil {
+		session = hashToken(token)
+	}
+	if tab := c.GetHeader(viewerHeader); tab != "" && len(tab) <= 64 {
+		return session + "|" + tab
+	}
+	return session + "|" + c.ClientIP() + "|" + c.Request.UserAgent()
+}
+
+// setPlayhead records that viewer is now at key.
+func setPlayhead(viewer string, key JobKey) {
+	playheadsMu.Lock()
+	playheads[viewer] = playhead{key: key, seen: time.Now()}
+	playheadsMu.Unlock()
+}
+
+// forgetPlayhead drops the viewer position if it still points at key:
+// the request for it was abandoned, so the viewer left or moved elsewhere.
+func forgetPlayhead(viewer string, key JobKey) {
+	playheadsMu.Lock()
+	if p, ok := playheads[viewer]; ok && p.key == key {
+		delete(playheads, viewer)
+	}
+	playheadsMu.Unlock()
+}
+
+// inPrefetchWindow reports whether a segment is among the next prefetchCount
+// of some active viewer of the same video and rendition.
+func inPrefetchWindow(key JobKey) bool {
+	playheadsMu.Lock()
+	defer playheadsMu.Unlock()
+
+	now := time.Now()
+	for viewer, p := range playheads {
+		if now.Sub(p.seen) > playheadTTL {
+			delete(playheads, viewer)
+			continue
+		}
+		if p.key.VideoID == key.VideoID && p.key.Rendition == key.Rendition &&
+			key.Segment > p.key.Segment && key.Segment <= p.key.Segment+prefetchCount {
+			return true
+		}
+	}
+	return false
+}
+
+// activeViewers returns how many viewers requested a segment recently.
+func activeViewers() int {
+	playheadsMu.Lock()
+	defer playheadsMu.Unlock()
+
+	n := 0
+	for _, p := range playheads {
+		if time.Since(p.seen) <= playheadTTL {
+			n++
+		}
+	}
+	return n
+}
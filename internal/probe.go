@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+// mediaProbeVersion is bumped when MediaInfo gains fields: a quick rescan
+// probes files recorded with an older version again.
+const mediaProbeVersion = 2
+
+// MediaInfo is what a single ffprobe pass tells us about a file.
+// It is embedded in VideoData, so its fields are flat in /files and videos.json.
+type MediaInfo struct {
+	ProbeVersion   int             `json:"probe_version"`
+	Duration       float64         `json:"duration"`
+	StartTime      float64         `json:"start_time"` // container start, packet times are relative to it
+	Width          int             `json:"width"`
+	Height         int             `json:"height"`
+	Container      string          `json:"container"`
+	Bitrate        int64           `json:"bitrate"` // bit/s, whole file
+	FrameRate      float64         `json:"frame_rate"`
+	VideoStream    int             `json:"video_stream"` // absolute index of the picture (0:N), cover art skipped
+	VideoCodec     string          `json:"video_codec"`
+	AudioCodec     string          `json:"audio_codec"` // first track, empty if the file has no audio
+	PixFmt         string          `json:"pix_fmt"`
+	HDR            bool            `json:"hdr"`
+	AudioTracks    []AudioTrack    `json:"audio_tracks"`
+	SubtitleTracks []SubtitleTrack `json:"subtitle_tracks"`
+	Chapters       []Chapter       `json:"chapters"`
+	ProbeError     string          `json:"probe_error,omitempty"`
+}
+
+// AudioTrack is an audio stream; Index is its position among audio streams (0:a:N).
+type AudioTrack struct {
+	Index    int    `json:"index"`
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Channels int    `json:"channels"`
+	Default  bool   `json:"default"`
+}
+
+// SubtitleTrack is a subtitle stream; Index is its position among subtitle streams (0:s:N).
+type SubtitleTrack struct {
+	Index    int    `json:"index"`
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Default  bool   `json:"default"`
+	Forced   bool   `json:"forced"`
+}
+
+// Chapter is a chapter marker, times in seconds.
+type Chapter struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Title string  `json:"title,omitempty"`
+}
+
+// ffprobe -of json output, only the fields we use
+type ffprobeOutput struct {
+	Format struct {
+		FormatName string            `json:"format_name"`
+		Duration   string            `json:"duration"`
+		StartTime  string            `json:"start_time"`
+		BitRate    string            `json:"bit_rate"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []struct {
+		Index         int               `json:"index"`
+		CodecType     string            `json:"codec_type"`
+		CodecName     string            `json:"codec_name"`
+		Width         int               `json:"width"`
+		Height        int               `json:"height"`
+		PixFmt        string            `json:"pix_fmt"`
+		AvgFrameRate  string            `json:"avg_frame_rate"`
+		RFrameRate    string            `json:"r_frame_rate"`
+		Duration      string            `json:"duration"`
+		Channels      int               `json:"channels"`
+		ColorTransfer string            `json:"color_transfer"`
+		Disposition   map[string]int    `json:"disposition"`
+		Tags          map[string]string `json:"tags"`
+		SideDataList  []map[string]any  `json:"side_data_list"`
+	} `json:"streams"`
+	Chapters []struct {
+		StartTime string            `json:"start_time"`
+		EndTime   string            `json:"end_time"`
+		Tags      map[string]string `json:"tags"`
+	} `json:"chapters"`
+}
+
+// probeMedia runs ffprobe once and returns the parsed info and the title
+// (metadata title, or the file name without extension).
+// On failure the error is also recorded in MediaInfo.ProbeError.
+func probeMedia(path string) (MediaInfo, string, error) {
+	title := nameWithoutExt(path)
+
+	cmd := exec.Command("ffprobe",
+		"-v", "error",
+		"-show_format", "-show_streams", "-show_chapters",
+		"-of", "json",
+		path,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		err = fmt.Errorf("ffprobe: %w: %s", err, strings.TrimSpace(stderr.String()))
+		return MediaInfo{ProbeVersion: mediaProbeVersion, ProbeError: err.Error()}, title, err
+	}
+
+	var probe ffprobeOutput
+	if err := json.Unmarshal(out, &probe); err != nil {
+		err = fmt.Errorf("ffprobe output: %w", err)
+		return MediaInfo{ProbeVersion: mediaProbeVersion, ProbeError: err.Error()}, title, err
+	}
+
+	info := MediaInfo{ProbeVersion: mediaProbeVersion, Container: probe.Format.FormatName}
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	info.StartTime, _ = strconv.ParseFloat(probe.Format.StartTime, 64)
+	info.Bitrate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	if t := strings.TrimSpace(probe.Format.Tags["title"]); t != "" {
+		title = t
+	}
+
+	videoFound := false
+	for _, s := range probe.Streams {
+		switch s.CodecType {
+		case "video":
+			// Cover art is a video stream too
+			if videoFound || s.Disposition["attached_pic"] == 1 {
+				continue
+			}
+			videoFound = true
+			info.VideoStream = s.Index
+			info.VideoCodec = s.CodecName
+			info.Width, info.Height = s.Width, s.Height
+			info.PixFmt = s.PixFmt
+			info.FrameRate = parseRational(s.AvgFrameRate)
+			if info.FrameRate <= 0 || info.FrameRate > 240 {
+				info.FrameRate = parseRational(s.RFrameRate)
+			}
+			info.HDR = s.ColorTransfer == "smpte2084" || s.ColorTransfer == "arib-std-b67" || hasDolbyVision(s.SideDataList)
+			if info.Duration <= 0 {
+				info.Duration, _ = strconv.ParseFloat(s.Duration, 64)
+			}
+		case "audio":
+			if len(info.AudioTracks) == 0 {
+				info.AudioCodec = s.CodecName
+			}
+			info.AudioTracks = append(info.AudioTracks, AudioTrack{
+				Index:    len(info.AudioTracks),
+				Codec:    s.CodecName,
+				Language: streamLanguage(s.Tags),
+				Title:    s.Tags["title"],
+				Channels: s.Channels,
+				Default:  s.Disposition["default"] == 1,
+			})
+		case "subtitle":
+			info.SubtitleTracks = append(info.SubtitleTracks, SubtitleTrack{
+				Index:    len(info.SubtitleTracks),
+				Codec:    s.CodecName,
+				Language: streamLanguage(s.Tags),
+				Title:    s.Tags["title"],
+				Default:  s.Disposition["default"] == 1,
+				Forced:   s.Disposition["forced"] == 1,
+			})
+		}
+	}
+
+	for _, ch := range probe.Chapters {
+		start, _ := strconv.ParseFloat(ch.StartTime, 64)
+		end, _ := strconv.ParseFloat(ch.EndTime, 64)
+		info.Chapters = append(info.Chapters, Chapter{Start: start, End: end, Title: ch.Tags["title"]})
+	}
+
+	// Partial results are kept, but the file is flagged
+	switch {
+	case !videoFound:
+		err = fmt.Errorf("no video stream")
+	case info.Duration <= 0:
+		err = fmt.Errorf("unknown duration")
+	}
+	if err != nil {
+		info.ProbeError = err.Error()
+	}
+	return info, title, err
+}
+
+// streamLanguage returns the ISO 639 language tag, "und" counts as none.
+func streamLanguage(tags map[string]string) string {
+	lang := strings.ToLower(tags["language"])
+	if lang == "und" {
+		return ""
+	}
+	return lang
+}
+
+// hlsLanguage turns an ISO 639 stream language ("ita", "ger") into the
+// RFC 5646 tag wanted by HLS ("it", "de") and the name of the language in
+// itself ("Italiano", "Deutsch"). Unknown codes are returned as they are.
+func hlsLanguage(lang string) (string, string) {
+	tag, err := language.Parse(lang)
+	if err != nil || tag == language.Und {
+		return lang, ""
+	}
+	name := []rune(display.Self.Name(tag))
+	if len(name) > 0 {
+		name[0] = unicode.ToUpper(name[0])
+	}
+	return tag.String(), string(name)
+}
+
+func hasDolbyVision(sideData []map[string]any) bool {
+	for _, sd := range sideData {
+		if t, _ := sd["side_data_type"].(string); strings.Contains(t, "DOVI") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,299 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const progressFile = "/data/progress.json" // JSON store only
+
+const (
+	resumeMinPosition = 30  // seconds: stopping earlier starts over next time
+	watchedRatio      = 0.9 // past this share of the duration (credits) a video is watched
+
+	// viewerCookie held the anonymous ID progress was recorded under before
+	// accounts; it is handed over to the first user logging in with it.
+	viewerCookie = "gazeparty_viewer"
+)
+
+// WatchProgress is where a user stopped watching a video.
+type WatchProgress struct {
+	UserID    string    `json:"user_id"`
+	VideoID   string    `json:"video_id"`
+	Position  float64   `json:"position"` // seconds
+	Duration  float64   `json:"duration"`
+	Watched   bool      `json:"watched"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Resumable reports whether the video belongs in "continue watching":
+// started and not finished.
+func (p WatchProgress) Resumable() bool {
+	return !p.Watched && p.Position >= resumeMinPosition
+}
+
+// reachedEnd reports whether a position counts as having watched the video.
+func reachedEnd(position, duration float64) bool {
+	return duration > 0 && position >= duration*watchedRatio
+}
+
+// progress mirrors the store, by user and video ID; loaded by LoadAndSyncVideos.
+var (
+	progress   = make(map[string]map[string]WatchProgress)
+	progressMu sync.Mutex
+)
+
+func loadProgress() error {
+	list, err := library.Progress()
+	if err != nil {
+		return err
+	}
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	for _, p := range list {
+		if progress[p.UserID] == nil {
+			progress[p.UserID] = make(map[string]WatchProgress)
+		}
+		progress[p.UserID][p.VideoID] = p
+	}
+	return nil
+}
+
+// findProgressLocked returns the progress of a user on a video, saved under
+// its current ID or, before a merge, under one of its aliases.
+func findProgressLocked(userID string, video *VideoData) (WatchProgress, bool) {
+	entries := progress[userID]
+	if p, ok := entries[video.ID]; ok {
+		return p, true
+	}
+	for _, alias := range video.Aliases {
+		if p, ok := entries[alias]; ok {
+			return p, true
+		}
+	}
+	return WatchProgress{}, false
+}
+
+// GetProgress returns the progress of a user on a video, if any.
+func GetProgress(userID string, video *VideoData) (WatchProgress, bool) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	return findProgressLocked(userID, video)
+}
+
+// updateProgress applies change to the progress of a user on a video (a zero
+// one if none) and saves it under the current video ID.
+func updateProgress(userID string, video *VideoData, change func(p *WatchProgress)) (WatchProgress, error) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+
+	old, found := findProgressLocked(userID, video)
+	p := old
+	p.UserID, p.VideoID = userID, video.ID
+	change(&p)
+	p.UpdatedAt = time.Now()
+	if err := library.PutProgress(p); err != nil {
+		return WatchProgress{}, err
+	}
+	if found && old.VideoID != video.ID {
+		library.DeleteProgress(userID, old.VideoID)
+		delete(progress[userID], old.VideoID)
+	}
+	if progress[userID] == nil {
+		progress[userID] = make(map[string]WatchProgress)
+	}
+	progress[userID][video.ID] = p
+	return p, nil
+}
+
+// deleteProgress forgets a user's progress on a video.
+func deleteProgress(userID string, video *VideoData) error {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+
+	for _, id := range append([]string{video.ID}, video.Aliases...) {
+		if _, ok := progress[userID][id]; !ok {
+			continue
+		}
+		if err := library.DeleteProgress(userID, id); err != nil {
+			return err
+		}
+		delete(progress[userID], id)
+	}
+	return nil
+}
+
+// progressUser identifies whose progress a request records: the logged-in
+// user (see RequireUser).
+func progressUser(c *gin.Context) string {
+	return userKey(currentUser(c).ID)
+}
+
+// claimViewerProgress moves the progress recorded under the request's
+// anonymous viewer cookie to the user logging in, and clears the cookie.
+func claimViewerProgress(c *gin.Context, userID string) {
+	viewer, err := c.Cookie(viewerCookie)
+	if err != nil {
+		return
+	}
+	// Anonymous IDs are 32 hex characters, never a user key
+	if len(viewer) == 32 {
+		if err := moveProgress(viewer, userID); err != nil {
+			// The cookie stays for the next login
+			fmt.Printf("[progress] error moving viewer progress: %v\n", err)
+			return
+		}
+	}
+	c.SetCookie(viewerCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+}
+
+// moveProgress gives every progress entry of one user ID to another. Where
+// both have one the most recent is kept.
+func moveProgress(from, to string) error {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+
+	for videoID, p := range progress[from] {
+		if cur, ok := progress[to][videoID]; !ok || p.UpdatedAt.After(cur.UpdatedAt) {
+			p.UserID = to
+			if err := library.PutProgress(p); err != nil {
+				return err
+			}
+			if progress[to] == nil {
+				progress[to] = make(map[string]WatchProgress)
+			}
+			progress[to][videoID] = p
+		}
+		if err := library.DeleteProgress(from, videoID); err != nil {
+			return err
+		}
+		delete(progress[from], videoID)
+	}
+	delete(progress, from)
+	return nil
+}
+
+// progressItem is a progress entry as listed by /progress, with its video.
+type progressItem struct {
+	WatchProgress
+	Continue bool      `json:"continue"`
+	Video    VideoData `json:"video"`
+}
+
+// GET /progress?filter=continue|watched, most recent first; videos no longer
+// in the library are skipped.
+func HandleListProgress(c *gin.Context) {
+	filter := c.Query("filter")
+	if filter != "" && filter != "continue" && filter != "watched" {
+		c.String(400, "filter must be continue or watched")
+		return
+	}
+	userID := progressUser(c)
+
+	progressMu.Lock()
+	entries := make([]WatchProgress, 0, len(progress[userID]))
+	for _, p := range progress[userID] {
+		entries = append(entries, p)
+	}
+	progressMu.Unlock()
+
+	items := []progressItem{}
+	for _, p := range entries {
+		video := GetVideoByID(p.VideoID)
+		if video == nil {
+			continue
+		}
+		if filter == "continue" && !p.Resumable() || filter == "watched" && !p.Watched {
+			continue
+		}
+		p.VideoID = video.ID
+		items = append(items, progressItem{WatchProgress: p, Continue: p.Resumable(), Video: *video})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].UpdatedAt.After(items[j].UpdatedAt) })
+	c.JSON(200, items)
+}
+
+// GET /progress/:id
+func HandleGetProgress(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	p, ok := GetProgress(progressUser(c), video)
+	if !ok {
+		c.String(404, "no progress")
+		return
+	}
+	p.VideoID = video.ID
+	c.JSON(200, progressItem{WatchProgress: p, Continue: p.Resumable(), Video: *video})
+}
+
+// PUT /progress/:id {"position": 1234.5, "duration": 5400, "watched": true}
+// The player heartbeat sends the position every few seconds; reaching the
+// end marks the video watched, "watched" sets or clears the flag by hand.
+func HandlePutProgress(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	var req struct {
+		Position *float64 `json:"position"`
+		Duration float64  `json:"duration"`
+		Watched  *bool    `json:"watched"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Position == nil && req.Watched == nil {
+		c.String(400, "position or watched required")
+		return
+	}
+	if req.Position != nil && (math.IsNaN(*req.Position) || *req.Position < 0) || math.IsNaN(req.Duration) || req.Duration < 0 {
+		c.String(400, "invalid position")
+		return
+	}
+
+	p, err := updateProgress(progressUser(c), video, func(p *WatchProgress) {
+		// The probed duration wins, the player one is for files without it
+		if video.Duration > 0 {
+			p.Duration = video.Duration
+		} else if req.Duration > 0 {
+			p.Duration = req.Duration
+		}
+		if req.Position != nil {
+			p.Position = *req.Position
+			if p.Duration > 0 {
+				p.Position = min(p.Position, p.Duration)
+			}
+			p.Watched = p.Watched || reachedEnd(p.Position, p.Duration)
+		}
+		if req.Watched != nil {
+			p.Watched = *req.Watched
+		}
+	})
+	if err != nil {
+		fmt.Printf("[progress] error: %v\n", err)
+		c.String(500, "error saving progress")
+		return
+	}
+	c.JSON(200, progressItem{WatchProgress: p, Continue: p.Resumable(), Video: *video})
+}
+
+// DELETE /progress/:id forgets the position and the watched flag.
+func HandleDeleteProgress(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	if err := deleteProgress(progressUser(c), video); err != nil {
+		fmt.Printf("[progress] error: %v\n", err)
+		c.String(500, "error saving progress")
+		return
+	}
+	c.Status(204)
+}
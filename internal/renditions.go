@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rendition is one quality level of the adaptive (ABR) stream.
+type Rendition struct {
+	Name        string // es. "720p", also the segment namespace on disk
+	Width       int
+	Height      int
+	BitrateKbps int    // target video bitrate
+	Level       string // H.264 level matching the resolution
+}
+
+// renditionLadder lists the ABR qualities by their short side.
+// Portrait videos use the same ladder, so "720p" of a 1080x1920 video is 720x1280.
+var renditionLadder = []Rendition{
+	{Name: "360p", Height: 360, BitrateKbps: 800, Level: "3.0"},
+	{Name: "720p", Height: 720, BitrateKbps: 2800, Level: "3.1"},
+	{Name: "1080p", Height: 1080, BitrateKbps: 5000, Level: "4.0"},
+}
+
+const audioBitrateKbps = 128
+
+// h264Levels maps the levels we encode with to their avc1 CODECS suffix (Main profile).
+var h264Levels = map[string]string{
+	"3.0": "4d401e",
+	"3.1": "4d401f",
+	"4.0": "4d4028",
+}
+
+// renditionsFor returns the ladder capped at the source resolution.
+// Sources smaller than the lowest rung get a single rendition at their own size.
+func renditionsFor(video *VideoData) []Rendition {
+	short := min(video.Width, video.Height)
+	if short <= 0 {
+		// Unknown resolution: the lowest rung is the only safe choice
+		short = renditionLadder[0].Height
+	}
+
+	var out []Rendition
+	for _, r := range renditionLadder {
+		if r.Height > short {
+			break
+		}
+		r.Width, r.Height = scaledSize(video.Width, video.Height, r.Height)
+		out = append(out, r)
+	}
+
+	if len(out) == 0 {
+		r := renditionLadder[0]
+		r.Name = fmt.Sprintf("%dp", short)
+		r.Width, r.Height = scaledSize(video.Width, video.Height, short)
+		out = append(out, r)
+	}
+	return out
+}
+
+// scaledSize scales w x h so that the short side equals short, keeping the
+// aspect ratio and rounding to even sizes as required by yuv420p.
+func scaledSize(w, h, short int) (int, int) {
+	if w <= 0 || h <= 0 {
+		// Assume 16:9 landscape when the probe failed
+		return even(short * 16 / 9), even(short)
+	}
+	if w >= h {
+		return even(w * short / h), even(short)
+	}
+	return even(short), even(h * short / w)
+}
+
+func even(n int) int {
+	return n + n%2
+}
+
+// findRendition returns the rendition with the given name for a video, or nil.
+func findRendition(video *VideoData, name string) *Rendition {
+	for _, r := range renditionsFor(video) {
+		if r.Name == name {
+			return &r
+		}
+	}
+	return nil
+}
+
+// mediaName picks the NAME of an #EXT-X-MEDIA entry: the track title, else
+// the language, else fallback and the track number. NAME must be unique in
+// a group, so a repeated name gets the track number too.
+func mediaName(used map[string]bool, title, language, fallback string, index int) string {
+	name := title
+	if name == "" {
+		name = language
+	}
+	if name == "" {
+		name = fmt.Sprintf("%s %d", fallback, index+1)
+	}
+	if used[name] {
+		name = fmt.Sprintf("%s (%d)", name, index+1)
+	}
+	used[name] = true
+	return strings.ReplaceAll(name, `"`, "'")
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "YES"
+	}
+	return "NO"
+}
+
+// GET /stream/:id/master.m3u8
+// ?mode=single lists only the single quality stream: the player still goes
+// through a master playlist to get the audio and subtitle tracks.
+// ?subs=burn:<track> points every variant at segments with that track drawn
+// on the picture, and offers no subtitle tracks.
+func HandleMaster(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	burn, ok := parseBurn(c, video)
+	if !ok {
+		return
+	}
+	query := ""
+	if burn != nil {
+		query = burnQuery(burn)
+	}
+
+	renditions := renditionsFor(video)
+	single := c.Query("mode") == "single"
+	fmt.Printf("[master] path=%s renditions=%d single=%v\n", video.Path, len(renditions), single)
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+
+	group := ""
+	if audio := audioMedia(video); audio != "" {
+		b.WriteString(audio)
+		group += `,AUDIO="audio"`
+	}
+	if subs := subtitleMedia(video); subs != "" && burn == nil {
+		b.WriteString(subs)
+		group += `,SUBTITLES="subs"`
+	}
+
+	if single {
+		// Remuxed or transcoded: the codecs are not known in advance
+		bandwidth := int64((3000 + audioBitrateKbps) * 1100)
+		if video.Bitrate > 0 {
+			bandwidth = video.Bitrate * 11 / 10
+		}
+		b.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", bandwidth))
+		if video.Width > 0 && video.Height > 0 {
+			b.WriteString(fmt.Sprintf(",RESOLUTION=%dx%d", video.Width, video.Height))
+		}
+		b.WriteString(group + "\n")
+		b.WriteString("playlist.m3u8" + query + "\n")
+	} else {
+		for _, r := range renditions {
+			// BANDWIDTH is the peak: VBV allows up to maxrate, plus audio and TS overhead
+			bandwidth := (r.BitrateKbps + audioBitrateKbps) * 1100
+			b.WriteString(fmt.Sprintf(
+				"#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"avc1.%s,mp4a.40.2\",NAME=\"%s\"%s\n",
+				bandwidth, r.Width, r.Height, h264Levels[r.Level], r.Name, group,
+			))
+			b.WriteString(fmt.Sprintf("rendition/%s/playlist.m3u8%s\n", r.Name, query))
+		}
+	}
+
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	c.String(200, b.String())
+}
+
+// GET /stream/:id/rendition/:rendition/playlist.m3u8
+func HandleRenditionPlaylist(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	if findRendition(video, c.Param("rendition")) == nil {
+		c.String(404, "rendition not found")
+		return
+	}
+	burn, ok := parseBurn(c, video)
+	if !ok {
+		return
+	}
+
+	writeMediaPlaylist(c, video, burn)
+}
+
+// GET /stream/:id/rendition/:rendition/segment_:n.ts
+func HandleRenditionSegment(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	rendition := findRendition(video, c.Param("rendition"))
+	if rendition == nil {
+		c.String(404, "rendition not found")
+		return
+	}
+
+	serveSegment(c, video, rendition)
+}
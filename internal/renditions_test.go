@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestScaledSize(t *testing.T) {
+	tests := []struct {
+		w, h, short  int
+		wantW, wantH int
+	}{
+		{1920, 1080, 720, 1280, 720},
+		{1920, 1080, 360, 640, 360},
+		{1080, 1920, 720, 720, 1280},
+		{853, 480, 360, 640, 360},   // odd width rounded up to even
+		{1000, 1000, 361, 362, 362}, // odd short side too
+		{0, 0, 360, 640, 360},       // unknown: 16:9
+		{1920, 0, 720, 1280, 720},
+	}
+	for _, tt := range tests {
+		w, h := scaledSize(tt.w, tt.h, tt.short)
+		if w != tt.wantW || h != tt.wantH {
+			t.Errorf("scaledSize(%d, %d, %d) = %dx%d, want %dx%d", tt.w, tt.h, tt.short, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestRenditionsFor(t *testing.T) {
+	tests := []struct {
+		w, h int
+		want []string // name:WxH
+	}{
+		{1920, 1080, []string{"360p:640x360", "720p:1280x720", "1080p:1920x1080"}},
+		{3840, 2160, []string{"360p:640x360", "720p:1280x720", "1080p:1920x1080"}},
+		{1280, 720, []string{"360p:640x360", "720p:1280x720"}},
+		{1080, 1920, []string{"360p:360x640", "720p:720x1280", "1080p:1080x1920"}},
+		{854, 480, []string{"360p:640x360"}},
+		{640, 272, []string{"272p:640x272"}},
+		{0, 0, []string{"360p:640x360"}},
+	}
+	for _, tt := range tests {
+		video := &VideoData{MediaInfo: MediaInfo{Width: tt.w, Height: tt.h}}
+		var got []string
+		for _, r := range renditionsFor(video) {
+			got = append(got, fmt.Sprintf("%s:%dx%d", r.Name, r.Width, r.Height))
+			if _, ok := h264Levels[r.Level]; !ok {
+				t.Errorf("%dx%d: rendition %s has unknown level %q", tt.w, tt.h, r.Name, r.Level)
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("renditionsFor(%dx%d) = %v, want %v", tt.w, tt.h, got, tt.want)
+		}
+	}
+}
+
+func TestMediaName(t *testing.T) {
+	used := make(map[string]bool)
+	tests := []struct {
+		title, language string
+		index           int
+		want            string
+	}{
+		{"Commentary", "en", 0, "Commentary"},
+		{"", "Italiano", 1, "Italiano"},
+		{"", "", 2, "Audio 3"},
+		{"", "Italiano", 3, "Italiano (4)"},
+		{`The "Cut"`, "", 4, "The 'Cut'"},
+	}
+	for _, tt := range tests {
+		if got := mediaName(used, tt.title, tt.language, "Audio", tt.index); got != tt.want {
+			t.Errorf("mediaName(%q, %q, %d) = %q, want %q", tt.title, tt.language, tt.index, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	roomIdleTimeout = 30 * time.Minute
+	roomPingPeriod  = 20 * time.Second
+	roomPongWait    = 45 * time.Second
+	roomWriteWait   = 10 * time.Second
+)
+
+// roomMaxDrift is the max distance (seconds) a client may drift from the host
+// before it is forced to seek. Override with GAZEPARTY_SYNC_DRIFT.
+var roomMaxDrift = envFloat("GAZEPARTY_SYNC_DRIFT", 0.5)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Accept same-origin browsers and non-browser clients only
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || origin == "http://"+r.Host || origin == "https://"+r.Host
+	},
+}
+
+// Room is a watch party: every client connected to it plays the same video
+// and follows the play/pause/seek/rate events of the others.
+type Room struct {
+	ID      string
+	VideoID string
+
+	mu        sync.Mutex
+	clients   map[*roomClient]struct{}
+	host      *roomClient
+	state     playbackState
+	idleTimer *time.Timer
+	closed    bool // removed from the registry, nobody may join
+}
+
+// playbackState is the shared position of the room, valid at UpdatedAt.
+type playbackState struct {
+	Playing   bool    `json:"playing"`
+	Position  float64 `json:"position"`
+	Rate      float64 `json:"rate"`
+	UpdatedAt int64   `json:"updated_at"` // server time, unix ms
+}
+
+// roomEvent is the message exchanged on the room WebSocket, in both directions.
+// Clients send play/pause/seek/rate (and sync when host); the server stamps
+// them with ServerTime and broadcasts them to everyone else.
+type roomEvent struct {
+	Type       string  `json:"type"`
+	Position   float64 `json:"position"`
+	Rate       float64 `json:"rate,omitempty"`
+	Playing    bool    `json:"playing"`
+	ServerTime int64   `json:"server_time,omitempty"`
+	From       string  `json:"from,omitempty"`
+	ClientID   string  `json:"client_id,omitempty"`
+	Host       bool    `json:"host,omitempty"`
+	MaxDrift   float64 `json:"max_drift,omitempty"`
+	Clients    int     `json:"clients,omitempty"`
+}
+
+type roomClient struct {
+	id   string
+	conn *websocket.Conn
+	send chan []byte
+}
+
+var (
+	rooms   = make(map[string]*Room)
+	roomsMu sync.Mutex
+)
+
+// current returns the state extrapolated to now.
+func (s playbackState) current(now time.Time) playbackState {
+	if s.Playing {
+		elapsed := float64(now.UnixMilli()-s.UpdatedAt) / 1000
+		s.Position += elapsed * s.Rate
+	}
+	s.UpdatedAt = now.UnixMilli()
+	return s
+}
+
+// CreateRoom creates a new room bound to the given video.
+func CreateRoom(videoID string) *Room {
+	room := &Room{
+		ID:      randomID(8),
+		VideoID: videoID,
+		clients: make(map[*roomClient]struct{}),
+		state:   playbackState{Rate: 1, UpdatedAt: time.Now().UnixMilli()},
+	}
+
+	roomsMu.Lock()
+	rooms[room.ID] = room
+	roomsMu.Unlock()
+
+	// A room nobody joins is dropped like an abandoned one
+	room.idleTimer = time.AfterFunc(roomIdleTimeout, room.closeIfEmpty)
+	fmt.Printf("[rooms] created room=%s video=%s\n", room.ID, videoID)
+	return room
+}
+
+// GetRoom returns a room by its ID.
+func GetRoom(id string) *Room {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	return rooms[id]
+}
+
+// join adds a client to the room; false if the room was closed meanwhile.
+func (r *Room) join(c *roomClient) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return false
+	}
+	if r.idleTimer != nil {
+		r.idleTimer.Stop()
+		r.idleTimer = nil
+	}
+	r.clients[c] = struct{}{}
+	if r.host == nil {
+		r.host = c
+	}
+
+	now := time.Now()
+	st := r.state.current(now)
+	c.sendEvent(roomEvent{
+		Type:       "welcome",
+		Position:   st.Position,
+		Rate:       st.Rate,
+		Playing:    st.Playing,
+		ServerTime: now.UnixMilli(),
+		ClientID:   c.id,
+		Host:       r.host == c,
+		MaxDrift:   roomMaxDrift,
+		Clients:    len(r.clients),
+	})
+	r.broadcastLocked(roomEvent{Type: "presence", Clients: len(r.clients), ServerTime: now.UnixMilli()}, c)
+	fmt.Printf("[rooms] room=%s client=%s joined (clients=%d)\n", r.ID, c.id, len(r.clients))
+	return true
+}
+
+func (r *Room) leave(c *roomClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.clients[c]; !ok {
+		return
+	}
+	delete(r.clients, c)
+	close(c.send)
+
+	now := time.Now().UnixMilli()
+	if r.host == c {
+		r.host = nil
+		// Promote any remaining client to host
+		for other := range r.clients {
+			r.host = other
+			other.sendEvent(roomEvent{Type: "host", Host: true, ServerTime: now})
+			break
+		}
+	}
+	r.broadcastLocked(roomEvent{Type: "presence", Clients: len(r.clients), ServerTime: now}, nil)
+
+	if len(r.clients) == 0 {
+		r.idleTimer = time.AfterFunc(roomIdleTimeout, r.closeIfEmpty)
+	}
+	fmt.Printf("[rooms] room=%s client=%s left (clients=%d)\n", r.ID, c.id, len(r.clients))
+}
+
+// closeIfEmpty drops a room nobody is in. It is marked closed under its own
+// lock, so a join racing with it fails instead of entering a dropped room.
+func (r *Room) closeIfEmpty() {
+	r.mu.Lock()
+	if len(r.clients) > 0 || r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	r.mu.Unlock()
+
+	roomsMu.Lock()
+	delete(rooms, r.ID)
+	roomsMu.Unlock()
+	fmt.Printf("[rooms] closed idle room=%s\n", r.ID)
+}
+
+// handleEvent applies an event sent by a client and relays it to the others.
+func (r *Room) handleEvent(from *roomClient, ev roomEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	st := r.state.current(now)
+
+	switch ev.Type {
+	case "play":
+		st.Playing = true
+		st.Position = ev.Position
+	case "pause":
+		st.Playing = false
+		st.Position = ev.Position
+	case "seek":
+		st.Position = ev.Position
+	case "rate":
+		if ev.Rate <= 0 {
+			return
+		}
+		st.Rate = ev.Rate
+		st.Position = ev.Position
+	case "sync":
+		// Only the host is the reference clock
+		if r.host != from {
+			return
+		}
+		st.Position = ev.Position
+		st.Playing = ev.Playing
+	default:
+		return
+	}
+	r.state = st
+
+	r.broadcastLocked(roomEvent{
+		Type:       ev.Type,
+		Position:   st.Position,
+		Rate:       st.Rate,
+		Playing:    st.Playing,
+		ServerTime: now.UnixMilli(),
+		From:       from.id,
+	}, from)
+}
+
+// broadcastLocked sends ev to every client except skip. r.mu must be held.
+func (r *Room) broadcastLocked(ev roomEvent, skip *roomClient) {
+	for c := range r.clients {
+		if c != skip {
+			c.sendEvent(ev)
+		}
+	}
+}
+
+// sendEvent queues ev without blocking; a client too slow to keep up
+// just misses events and gets corrected by the next sync.
+func (c *roomClient) sendEvent(ev roomEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+	}
+}
+
+func (c *roomClient) writeLoop() {
+	ticker := time.NewTicker(roomPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(roomWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(roomWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *roomClient) readLoop(room *Room) {
+	defer func() {
+		room.leave(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(4096)
+	c.conn.SetReadDeadline(time.Now().Add(roomPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(roomPongWait))
+		return nil
+	})
+
+	for {
+		var ev roomEvent
+		if err := c.conn.ReadJSON(&ev); err != nil {
+			return
+		}
+		room.handleEvent(c, ev)
+	}
+}
+
+// POST /rooms
+func HandleCreateRoom(c *gin.Context) {
+	var req struct {
+		VideoID string `json:"video_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.VideoID == "" {
+		c.String(400, "video_id required")
+		return
+	}
+	video := GetVideoByID(req.VideoID)
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+
+	room := CreateRoom(video.ID)
+	c.JSON(201, gin.H{"id": room.ID, "video_id": room.VideoID})
+}
+
+// GET /rooms/:room
+func HandleGetRoom(c *gin.Context) {
+	room := GetRoom(c.Param("room"))
+	if room == nil {
+		c.String(404, "room not found")
+		return
+	}
+
+	room.mu.Lock()
+	st := room.state.current(time.Now())
+	clients := len(room.clients)
+	room.mu.Unlock()
+
+	c.JSON(200, gin.H{"id": room.ID, "video_id": room.VideoID, "clients": clients, "state": st})
+}
+
+// GET /rooms/:room/ws
+func HandleRoomSocket(c *gin.Context) {
+	room := GetRoom(c.Param("room"))
+	if room == nil {
+		c.String(404, "room not found")
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		fmt.Printf("[rooms] upgrade error: %v\n", err)
+		return
+	}
+
+	client := &roomClient{id: randomID(4), conn: conn, send: make(chan []byte, 32)}
+	go client.writeLoop()
+	if !room.join(client) {
+		// Closed between lookup and join: the write loop says goodbye
+		close(client.send)
+		return
+	}
+	client.readLoop(room)
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
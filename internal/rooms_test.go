@@ -0,0 +1,35 @@
+package internal
+
+import "testing"
+
+func TestRoomCloseIfEmpty(t *testing.T) {
+	newClient := func() *roomClient { return &roomClient{id: randomID(4), send: make(chan []byte, 8)} }
+
+	// Closed before anyone joined: a late join is refused
+	room := CreateRoom("video")
+	room.closeIfEmpty()
+	if GetRoom(room.ID) != nil {
+		t.Fatal("empty room still registered")
+	}
+	if room.join(newClient()) {
+		t.Error("join succeeded on a closed room")
+	}
+
+	// Someone joined in time: the room stays
+	room = CreateRoom("video")
+	c := newClient()
+	if !room.join(c) {
+		t.Fatal("join refused on an open room")
+	}
+	room.closeIfEmpty()
+	if GetRoom(room.ID) != room {
+		t.Error("room with a client was closed")
+	}
+
+	// Last one left: closing works again
+	room.leave(c)
+	room.closeIfEmpty()
+	if GetRoom(room.ID) != nil {
+		t.Error("abandoned room still registered")
+	}
+}
@@ -0,0 +1,346 @@
+package internal
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// JobPriority orders the transcode queue: lower values run first.
+type JobPriority int
+
+const (
+	PriorityForeground JobPriority = iota // a viewer is waiting for this segment
+	PriorityPrefetch                      // segments ahead of a viewer
+	PriorityBackground                    // work nobody is watching (pre-transcode)
+)
+
+func (p JobPriority) String() string {
+	switch p {
+	case PriorityForeground:
+		return "foreground"
+	case PriorityPrefetch:
+		return "prefetch"
+	case PriorityBackground:
+		return "background"
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+// JobKey identifies a job: the same key is never encoded twice at once.
+type JobKey struct {
+	VideoID   string `json:"video_id"`
+	Rendition string `json:"rendition"` // empty for the single quality stream
+	Segment   int    `json:"segment"`
+}
+
+// Job is a unit of work (one ffmpeg run) in the transcode queue.
+type Job struct {
+	Key      JobKey
+	Priority JobPriority
+
+	run      func(ctx context.Context) error
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	prev     *Job // cancelled job for the same key, still shutting down
+	err      error
+	waiters  int    // requests blocked on this job
+	seq      uint64 // FIFO order within the same priority
+	index    int    // position in the heap, -1 once started
+	queuedAt time.Time
+	started  time.Time
+}
+
+// finished reports whether the job is over (done, failed or cancelled).
+func (j *Job) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// jobHeap implements heap.Interface on priority, then submission order.
+type jobHeap []*Job
+
+func (h jobHeap) Len() int { return len(h) }
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].Priority != h[j].Priority {
+		return h[i].Priority < h[j].Priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *jobHeap) Push(x any) {
+	job := x.(*Job)
+	job.index = len(*h)
+	*h = append(*h, job)
+}
+func (h *jobHeap) Pop() any {
+	old := *h
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	job.index = -1
+	*h = old[:len(old)-1]
+	return job
+}
+
+// Scheduler runs jobs on a fixed pool of workers, so the number of concurrent
+// ffmpeg processes is bounded whatever the number of viewers.
+// A job nobody waits for is cancelled (killing ffmpeg if running) unless keep
+// says it is still wanted, e.g. because it is inside a viewer's prefetch window.
+type Scheduler struct {
+	mu        sync.Mutex
+	wake      *sync.Cond
+	queue     jobHeap
+	jobs      map[JobKey]*Job // queued and running
+	dying     map[JobKey]*Job // cancelled but still running
+	keep      func(JobKey) bool
+	workers   int
+	running   int
+	seq       uint64
+	completed uint64
+	failed    uint64
+	cancelled uint64
+}
+
+// transcoder is the scheduler shared by every segment request.
+var transcoder *Scheduler
+
+// NewScheduler creates a scheduler and starts its workers.
+// keep tells whether a job without waiters is still worth running.
+func NewScheduler(workers int, keep func(JobKey) bool) *Scheduler {
+	s := &Scheduler{
+		jobs:    make(map[JobKey]*Job),
+		dying:   make(map[JobKey]*Job),
+		keep:    keep,
+		workers: max(1, workers),
+	}
+	s.wake = sync.NewCond(&s.mu)
+	for i := 0; i < s.workers; i++ {
+		go s.worker()
+	}
+	return s
+}
+
+// StartScheduler starts the transcode queue.
+// The number of workers comes from GAZEPARTY_WORKERS (default 2).
+func StartScheduler() {
+	transcoder = NewScheduler(envInt("GAZEPARTY_WORKERS", 2), inPrefetchWindow)
+
+	// Viewers that stop requesting without closing the connection
+	// (paused, crashed) are noticed when their playhead expires
+	ticker := time.NewTicker(10 * time.Second)
+	go func() {
+		for range ticker.C {
+			transcoder.Reap()
+		}
+	}()
+	fmt.Printf("[scheduler] started: workers=%d\n", transcoder.workers)
+}
+
+// Submit queues a job nobody waits for (e.g. prefetch), or returns the one
+// already queued/running for key. A duplicate submitted with a higher
+// priority promotes the queued job.
+func (s *Scheduler) Submit(key JobKey, priority JobPriority, run func(ctx context.Context) error) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.submitLocked(key, priority, run)
+}
+
+// Run submits a job and waits for it. If ctx ends first (the viewer left or
+// seeked away) the wait is abandoned, and the job cancelled if it was the last
+// waiter and the job is not wanted anymore.
+func (s *Scheduler) Run(ctx context.Context, key JobKey, priority JobPriority, run func(ctx context.Context) error) error {
+	s.mu.Lock()
+	job := s.submitLocked(key, priority, run)
+	job.waiters++
+	s.mu.Unlock()
+
+	var err error
+	select {
+	case <-job.done:
+		err = job.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	job.waiters--
+	if job.waiters == 0 && !job.finished() && !s.keep(job.Key) {
+		s.cancelLocked(job)
+	}
+	s.mu.Unlock()
+	return err
+}
+
+func (s *Scheduler) submitLocked(key JobKey, priority JobPriority, run func(ctx context.Context) error) *Job {
+	if job, ok := s.jobs[key]; ok {
+		if priority < job.Priority && job.index >= 0 {
+			job.Priority = priority
+			heap.Fix(&s.queue, job.index)
+		}
+		return job
+	}
+
+	s.seq++
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		Key:      key,
+		Priority: priority,
+		run:      run,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		seq:      s.seq,
+		prev:     s.dying[key],
+		queuedAt: time.Now(),
+	}
+	s.jobs[key] = job
+	heap.Push(&s.queue, job)
+	s.wake.Signal()
+	return job
+}
+
+func (s *Scheduler) worker() {
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 {
+			s.wake.Wait()
+		}
+		job := heap.Pop(&s.queue).(*Job)
+		job.started = time.Now()
+		s.running++
+		s.mu.Unlock()
+
+		// Never write the same output while a killed ffmpeg is cleaning up
+		if job.prev != nil {
+			<-job.prev.done
+			job.prev = nil
+		}
+		err := job.run(job.ctx)
+
+		s.mu.Lock()
+		job.err = err
+		s.running--
+		switch {
+		case job.ctx.Err() != nil:
+			// cancelLocked already accounted for it
+		case err != nil:
+			s.failed++
+		default:
+			s.completed++
+		}
+		if s.jobs[job.Key] == job {
+			delete(s.jobs, job.Key)
+		}
+		if s.dying[job.Key] == job {
+			delete(s.dying, job.Key)
+		}
+		job.cancel()
+		s.mu.Unlock()
+		close(job.done)
+	}
+}
+
+// Reap cancels every job that has no waiters and is no longer wanted.
+func (s *Scheduler) Reap() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, job := range s.jobs {
+		if job.waiters == 0 && !s.keep(job.Key) {
+			s.cancelLocked(job)
+		}
+	}
+}
+
+// cancelLocked drops a queued job or kills a running one. s.mu must be held.
+func (s *Scheduler) cancelLocked(job *Job) {
+	if job.ctx.Err() != nil {
+		return
+	}
+	fmt.Printf("[scheduler] cancelling orphaned job video=%s rendition=%s seg=%d\n", job.Key.VideoID, job.Key.Rendition, job.Key.Segment)
+	job.cancel()
+	s.cancelled++
+	delete(s.jobs, job.Key)
+
+	if job.index >= 0 {
+		// Never started: nobody will run it, finish it here
+		heap.Remove(&s.queue, job.index)
+		job.err = context.Canceled
+		close(job.done)
+		return
+	}
+	// A running job ends as soon as ffmpeg is killed, the worker closes it
+	s.dying[job.Key] = job
+}
+
+// QueueStats is a snapshot of the scheduler, for the admin endpoint.
+type QueueStats struct {
+	Workers   int              `json:"workers"`
+	Running   int              `json:"running"`
+	Queued    int              `json:"queued"`
+	ByPrio    map[string]int   `json:"queued_by_priority"`
+	Completed uint64           `json:"completed"`
+	Failed    uint64           `json:"failed"`
+	Cancelled uint64           `json:"cancelled"`
+	Jobs      []QueueJobStatus `json:"jobs"`
+}
+
+type QueueJobStatus struct {
+	JobKey
+	Priority string `json:"priority"`
+	State    string `json:"state"`
+	AgeMs    int64  `json:"age_ms"` // time in queue, or running time once started
+	Waiters  int    `json:"waiters"`
+}
+
+// Stats returns queue depth and the list of queued and running jobs.
+func (s *Scheduler) Stats() QueueStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	stats := QueueStats{
+		Workers:   s.workers,
+		Running:   s.running,
+		Queued:    len(s.queue),
+		ByPrio:    make(map[string]int),
+		Completed: s.completed,
+		Failed:    s.failed,
+		Cancelled: s.cancelled,
+	}
+	for _, job := range s.jobs {
+		st := QueueJobStatus{
+			JobKey:   job.Key,
+			Priority: job.Priority.String(),
+			State:    "queued",
+			AgeMs:    now.Sub(job.queuedAt).Milliseconds(),
+			Waiters:  job.waiters,
+		}
+		if job.index < 0 {
+			st.State = "running"
+			st.AgeMs = now.Sub(job.started).Milliseconds()
+		} else {
+			stats.ByPrio[job.Priority.String()]++
+		}
+		stats.Jobs = append(stats.Jobs, st)
+	}
+	return stats
+}
+
+// GET /admin/queue
+func HandleQueueStats(c *gin.Context) {
+	c.JSON(200, transcoder.Stats())
+}
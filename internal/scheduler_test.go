@@ -0,0 +1,293 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func keepAll(JobKey) bool { return true }
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// blockWorker occupies a worker of s until the returned func is called.
+func blockWorker(t *testing.T, s *Scheduler, key JobKey) func() {
+	t.Helper()
+	started, release := make(chan struct{}), make(chan struct{})
+	s.Submit(key, PriorityForeground, func(context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	return func() { close(release) }
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s := NewScheduler(1, keepAll)
+	release := blockWorker(t, s, JobKey{VideoID: "blocker"})
+
+	var mu sync.Mutex
+	var order []string
+	var jobs []*Job
+	submit := func(name string, priority JobPriority) {
+		jobs = append(jobs, s.Submit(JobKey{VideoID: name}, priority, func(context.Context) error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return nil
+		}))
+	}
+	submit("bg1", PriorityBackground)
+	submit("prefetch1", PriorityPrefetch)
+	submit("bg2", PriorityBackground)
+	submit("fg", PriorityForeground)
+	submit("prefetch2", PriorityPrefetch)
+	submit("bg3", PriorityBackground)
+	// A duplicate with a higher priority promotes the queued job
+	s.Submit(JobKey{VideoID: "bg3"}, PriorityForeground, nil)
+
+	release()
+	for _, job := range jobs {
+		<-job.done
+	}
+	want := []string{"fg", "bg3", "prefetch1", "prefetch2", "bg1", "bg2"}
+	if len(order) != len(want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("order = %v, want %v", order, want)
+		}
+	}
+}
+
+func TestSchedulerDedup(t *testing.T) {
+	s := NewScheduler(2, keepAll)
+	key := JobKey{VideoID: "v", Rendition: "720p", Segment: 3}
+	started, release := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	runs := 0
+	run := func(context.Context) error {
+		mu.Lock()
+		runs++
+		mu.Unlock()
+		close(started)
+		<-release
+		return nil
+	}
+
+	first := s.Submit(key, PriorityPrefetch, run)
+	<-started
+	if again := s.Submit(key, PriorityBackground, run); again != first {
+		t.Error("Submit of a running key created another job")
+	}
+	// Other renditions and segments are different jobs
+	other := s.Submit(JobKey{VideoID: "v", Rendition: "360p", Segment: 3}, PriorityBackground, func(context.Context) error { return nil })
+	<-other.done
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Run(context.Background(), key, PriorityForeground, run); err != nil {
+				t.Errorf("Run = %v", err)
+			}
+		}()
+	}
+	waitFor(t, "waiters", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return first.waiters == 3
+	})
+	close(release)
+	wg.Wait()
+	if runs != 1 {
+		t.Errorf("run called %d times, want 1", runs)
+	}
+
+	// Once done the key can be encoded again
+	again := s.Submit(key, PriorityBackground, func(context.Context) error { return nil })
+	if again == first {
+		t.Error("finished job returned for a new submit")
+	}
+	<-again.done
+}
+
+func TestSchedulerWorkerBound(t *testing.T) {
+	const workers = 2
+	s := NewScheduler(workers, keepAll)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	running, peak := 0, 0
+	var jobs []*Job
+	for i := range 6 {
+		jobs = append(jobs, s.Submit(JobKey{VideoID: "v", Segment: i}, PriorityPrefetch, func(context.Context) error {
+			mu.Lock()
+			running++
+			peak = max(peak, running)
+			mu.Unlock()
+			<-release
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return nil
+		}))
+	}
+
+	waitFor(t, "workers busy", func() bool { return s.Stats().Running == workers })
+	time.Sleep(20 * time.Millisecond) // a third worker would show up by now
+	if stats := s.Stats(); stats.Running != workers || stats.Queued != 6-workers {
+		t.Errorf("running=%d queued=%d, want %d and %d", stats.Running, stats.Queued, workers, 6-workers)
+	}
+	close(release)
+	for _, job := range jobs {
+		<-job.done
+	}
+	if peak != workers {
+		t.Errorf("peak concurrency = %d, want %d", peak, workers)
+	}
+	if stats := s.Stats(); stats.Completed != 6 || len(stats.Jobs) != 0 {
+		t.Errorf("completed=%d jobs=%d, want 6 and 0", stats.Completed, len(stats.Jobs))
+	}
+}
+
+func TestSchedulerReap(t *testing.T) {
+	var mu sync.Mutex
+	wanted := map[string]bool{"queued-wanted": true, "blocker": true}
+	s := NewScheduler(1, func(key JobKey) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return wanted[key.VideoID]
+	})
+	release := blockWorker(t, s, JobKey{VideoID: "blocker"})
+	defer release()
+
+	noop := func(context.Context) error { return nil }
+	orphan := s.Submit(JobKey{VideoID: "queued-orphan"}, PriorityPrefetch, noop)
+	kept := s.Submit(JobKey{VideoID: "queued-wanted"}, PriorityPrefetch, noop)
+
+	// A job with a waiter stays even outside the window
+	ctx, cancel := context.WithCancel(context.Background())
+	waited := make(chan error)
+	go func() { waited <- s.Run(ctx, JobKey{VideoID: "queued-waited"}, PriorityForeground, noop) }()
+	waitFor(t, "waiter", func() bool { return len(s.Stats().Jobs) == 4 })
+
+	s.Reap()
+	<-orphan.done
+	if orphan.err != context.Canceled {
+		t.Errorf("orphan err = %v, want context.Canceled", orphan.err)
+	}
+	if kept.finished() {
+		t.Error("job inside the window cancelled")
+	}
+	stats := s.Stats()
+	if stats.Cancelled != 1 || stats.Queued != 2 {
+		t.Errorf("cancelled=%d queued=%d, want 1 and 2", stats.Cancelled, stats.Queued)
+	}
+
+	// The waiter leaving cancels its job right away
+	cancel()
+	if err := <-waited; err != context.Canceled {
+		t.Errorf("Run after the viewer left = %v", err)
+	}
+	if s.Stats().Cancelled != 2 {
+		t.Error("job of the gone waiter not cancelled")
+	}
+
+	// Leaving the window later gets a job reaped too
+	mu.Lock()
+	delete(wanted, "queued-wanted")
+	mu.Unlock()
+	s.Reap()
+	<-kept.done
+	if s.Stats().Queued != 0 {
+		t.Errorf("queued = %d after reaping everything", s.Stats().Queued)
+	}
+}
+
+func TestSchedulerDyingChain(t *testing.T) {
+	var mu sync.Mutex
+	want := true
+	s := NewScheduler(2, func(JobKey) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return want
+	})
+	key := JobKey{VideoID: "v", Segment: 7}
+
+	// The first run notices the cancel but takes a while to clean up, like ffmpeg
+	started, cleanup := make(chan struct{}), make(chan struct{})
+	var events []string
+	var eventsMu sync.Mutex
+	event := func(e string) {
+		eventsMu.Lock()
+		events = append(events, e)
+		eventsMu.Unlock()
+	}
+	first := s.Submit(key, PriorityPrefetch, func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		<-cleanup
+		event("first exited")
+		return ctx.Err()
+	})
+	<-started
+
+	mu.Lock()
+	want = false
+	mu.Unlock()
+	s.Reap()
+	s.mu.Lock()
+	dying := s.dying[key]
+	s.mu.Unlock()
+	if dying != first {
+		t.Fatal("cancelled running job not kept as dying")
+	}
+
+	// The viewer seeks back: same key, a new job chained to the dying one
+	mu.Lock()
+	want = true
+	mu.Unlock()
+	second := s.Submit(key, PriorityForeground, func(context.Context) error {
+		event("second started")
+		return nil
+	})
+	if second == first || second.prev != first {
+		t.Fatal("new job not chained to the dying one")
+	}
+	time.Sleep(20 * time.Millisecond) // the free worker has picked it up by now
+	eventsMu.Lock()
+	early := len(events) > 0
+	eventsMu.Unlock()
+	if early {
+		t.Error("new job started while the old one was still running")
+	}
+
+	close(cleanup)
+	<-second.done
+	if len(events) != 2 || events[0] != "first exited" || events[1] != "second started" {
+		t.Errorf("events = %v, want the first to exit before the second starts", events)
+	}
+	s.mu.Lock()
+	left := len(s.dying) + len(s.jobs)
+	s.mu.Unlock()
+	if left != 0 {
+		t.Errorf("%d jobs left in the scheduler", left)
+	}
+	if stats := s.Stats(); stats.Cancelled != 1 || stats.Completed != 1 || stats.Failed != 0 {
+		t.Errorf("cancelled=%d completed=%d failed=%d, want 1, 1, 0", stats.Cancelled, stats.Completed, stats.Failed)
+	}
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// VideoQuery filters, sorts and pages the library for GET /files.
+type VideoQuery struct {
+	Text        string   // every word must match name or path, ignoring case and accents
+	MinDuration float64  // seconds, 0 = no limit
+	MaxDuration float64  // seconds, 0 = no limit
+	MinHeight   int      // pixels, 0 = no limit
+	MaxHeight   int      // pixels, 0 = no limit
+	Codecs      []string // video codecs, empty = any
+	Folder      string   // relative to videoDir, subfolders included
+	Sort        string   // name, path, duration, height, size, mtime
+	Desc        bool
+	Limit       int
+	Cursor      string // from the previous page's next_cursor
+}
+
+// VideoPage is one page of results.
+type VideoPage struct {
+	Items      []VideoData `json:"items"`
+	Total      int         `json:"total"` // matches over all pages
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// sortKey is the position of a video in a sorted listing; the ID breaks ties
+// so the order is total and a cursor always points between two videos.
+type sortKey struct {
+	S  string  `json:"s,omitempty"`
+	N  float64 `json:"n,omitempty"`
+	ID string  `json:"id"`
+}
+
+var sortKeys = map[string]func(v *VideoData) sortKey{
+	"name":     func(v *VideoData) sortKey { return sortKey{S: foldText(v.Name)} },
+	"path":     func(v *VideoData) sortKey { return sortKey{S: v.Path} },
+	"duration": func(v *VideoData) sortKey { return sortKey{N: v.Duration} },
+	"height":   func(v *VideoData) sortKey { return sortKey{N: float64(v.Height)} },
+	"size":     func(v *VideoData) sortKey { return sortKey{N: float64(v.Size)} },
+	"mtime":    func(v *VideoData) sortKey { return sortKey{N: float64(v.ModTime)} },
+}
+
+func (a sortKey) less(b sortKey) bool {
+	if a.S != b.S {
+		return a.S < b.S
+	}
+	if a.N != b.N {
+		return a.N < b.N
+	}
+	return a.ID < b.ID
+}
+
+// foldText lowercases and strips accents: "Amélie" matches "amelie".
+func foldText(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// parseVideoQuery reads the query string of GET /files.
+func parseVideoQuery(c *gin.Context) (VideoQuery, error) {
+	q := VideoQuery{
+		Text:   c.Query("q"),
+		Folder: strings.Trim(c.Query("folder"), "/"),
+		Sort:   c.DefaultQuery("sort", "name"),
+		Desc:   c.Query("order") == "desc",
+		Limit:  defaultPageSize,
+		Cursor: c.Query("cursor"),
+	}
+	if _, ok := sortKeys[q.Sort]; !ok {
+		return q, fmt.Errorf("unknown sort %q", q.Sort)
+	}
+	if codecs := c.Query("codec"); codecs != "" {
+		q.Codecs = strings.Split(strings.ToLower(codecs), ",")
+	}
+
+	var err error
+	parseFloat := func(name string, dst *float64) {
+		if s := c.Query(name); s != "" && err == nil {
+			if *dst, err = strconv.ParseFloat(s, 64); err != nil {
+				err = fmt.Errorf("invalid %s", name)
+			}
+		}
+	}
+	parseInt := func(name string, dst *int) {
+		if s := c.Query(name); s != "" && err == nil {
+			if *dst, err = strconv.Atoi(s); err != nil || *dst < 0 {
+				err = fmt.Errorf("invalid %s", name)
+			}
+		}
+	}
+	parseFloat("min_duration", &q.MinDuration)
+	parseFloat("max_duration", &q.MaxDuration)
+	parseInt("min_height", &q.MinHeight)
+	parseInt("max_height", &q.MaxHeight)
+	parseInt("limit", &q.Limit)
+	if err == nil && q.Limit == 0 {
+		err = fmt.Errorf("invalid limit")
+	}
+	q.Limit = min(q.Limit, maxPageSize)
+	return q, err
+}
+
+func (q *VideoQuery) match(v *VideoData, words []string) bool {
+	switch {
+	case q.MinDuration > 0 && v.Duration < q.MinDuration,
+		q.MaxDuration > 0 && v.Duration > q.MaxDuration,
+		q.MinHeight > 0 && v.Height < q.MinHeight,
+		q.MaxHeight > 0 && v.Height > q.MaxHeight:
+		return false
+	}
+	if len(q.Codecs) > 0 && !containsString(q.Codecs, v.VideoCodec) {
+		return false
+	}
+	if q.Folder != "" && !strings.HasPrefix(v.Path, filepath.Join(videoDir, q.Folder)+string(filepath.Separator)) {
+		return false
+	}
+	if len(words) > 0 {
+		text := foldText(v.Name + " " + v.Path)
+		for _, w := range words {
+			if !strings.Contains(text, w) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SearchVideos returns the page of the library selected by q.
+func SearchVideos(q VideoQuery) (VideoPage, error) {
+	var after *sortKey
+	if q.Cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err != nil {
+			return VideoPage{}, fmt.Errorf("invalid cursor")
+		}
+		after = &sortKey{}
+		if err := json.Unmarshal(data, after); err != nil {
+			return VideoPage{}, fmt.Errorf("invalid cursor")
+		}
+	}
+
+	keyOf := sortKeys[q.Sort]
+	words := strings.Fields(foldText(q.Text))
+	type entry struct {
+		video *VideoData
+		key   sortKey
+	}
+	videos := GetVideos()
+	var matches []entry
+	for i := range videos {
+		v := &videos[i]
+		if q.match(v, words) {
+			key := keyOf(v)
+			key.ID = v.ID
+			matches = append(matches, entry{v, key})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if q.Desc {
+			return matches[j].key.less(matches[i].key)
+		}
+		return matches[i].key.less(matches[j].key)
+	})
+
+	// Keyset pagination: changes to the library between two pages don't
+	// skip or repeat videos
+	start := 0
+	if after != nil {
+		start = sort.Search(len(matches), func(i int) bool {
+			if q.Desc {
+				return matches[i].key.less(*after)
+			}
+			return after.less(matches[i].key)
+		})
+	}
+	end := min(start+q.Limit, len(matches))
+
+	page := VideoPage{Items: make([]VideoData, 0, end-start), Total: len(matches)}
+	for _, m := range matches[start:end] {
+		page.Items = append(page.Items, *m.video)
+	}
+	if end < len(matches) {
+		data, _ := json.Marshal(matches[end-1].key)
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(data)
+	}
+	return page, nil
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFoldText(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Amélie", "amelie"},
+		{"PERCHÉ NO", "perche no"},
+		{"Ærø Ñandú", "ærø nandu"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := foldText(tt.in); got != tt.want {
+			t.Errorf("foldText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseVideoQuery(t *testing.T) {
+	tests := []struct {
+		query     string
+		wantLimit int
+		wantErr   bool
+	}{
+		{"", defaultPageSize, false},
+		{"limit=10", 10, false},
+		{"limit=500", maxPageSize, false},
+		{"limit=100000", maxPageSize, false},
+		{"limit=0", 0, true},
+		{"limit=-1", 0, true},
+		{"limit=abc", 0, true},
+		{"sort=bogus", 0, true},
+		{"min_duration=x", 0, true},
+		{"min_height=-5", 0, true},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/files?"+tt.query, nil)
+		q, err := parseVideoQuery(c)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseVideoQuery(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && q.Limit != tt.wantLimit {
+			t.Errorf("parseVideoQuery(%q) limit = %d, want %d", tt.query, q.Limit, tt.wantLimit)
+		}
+	}
+}
+
+// withLibrary swaps the in-memory library for the length of a test.
+func withLibrary(t *testing.T, videos []VideoData) {
+	t.Helper()
+	cacheMu.Lock()
+	oldCache, oldIndex := videoCache, videoIndex
+	setVideoCacheLocked(videos)
+	cacheMu.Unlock()
+	t.Cleanup(func() {
+		cacheMu.Lock()
+		videoCache, videoIndex = oldCache, oldIndex
+		cacheMu.Unlock()
+	})
+}
+
+func TestSearchVideosPagination(t *testing.T) {
+	withLibrary(t, []VideoData{
+		{ID: "a", Path: "/video/Movies/Amélie.mkv", Name: "Amélie", MediaInfo: MediaInfo{Duration: 7200}},
+		{ID: "b", Path: "/video/Movies/Brazil.mkv", Name: "Brazil", MediaInfo: MediaInfo{Duration: 8400}},
+		{ID: "c", Path: "/video/Series/Show.S01E01.mkv", Name: "Show", MediaInfo: MediaInfo{Duration: 1500}},
+		{ID: "d", Path: "/video/Series/Show.S01E02.mkv", Name: "Show", MediaInfo: MediaInfo{Duration: 1500}},
+		{ID: "e", Path: "/video/Movies/casablanca.mkv", Name: "casablanca", MediaInfo: MediaInfo{Duration: 6120}},
+	})
+
+	tests := []struct {
+		name string
+		q    VideoQuery
+		want []string
+	}{
+		{"name asc", VideoQuery{Sort: "name"}, []string{"a", "b", "e", "c", "d"}},
+		{"name desc", VideoQuery{Sort: "name", Desc: true}, []string{"d", "c", "e", "b", "a"}},
+		{"ties broken by ID", VideoQuery{Sort: "duration"}, []string{"c", "d", "e", "a", "b"}},
+		{"text ignores accents", VideoQuery{Sort: "name", Text: "AMELIE"}, []string{"a"}},
+		{"folder", VideoQuery{Sort: "path", Folder: "Series"}, []string{"c", "d"}},
+		{"duration range", VideoQuery{Sort: "name", MinDuration: 6000, MaxDuration: 8000}, []string{"a", "e"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Two per page: following next_cursor must visit every match once
+			q := tt.q
+			q.Limit = 2
+			var got []string
+			for pages := 0; pages < 10; pages++ {
+				page, err := SearchVideos(q)
+				if err != nil {
+					t.Fatalf("SearchVideos() error = %v", err)
+				}
+				if page.Total != len(tt.want) {
+					t.Errorf("total = %d, want %d", page.Total, len(tt.want))
+				}
+				for _, v := range page.Items {
+					got = append(got, v.ID)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				q.Cursor = page.NextCursor
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchVideosInvalidCursor(t *testing.T) {
+	withLibrary(t, nil)
+	for _, cursor := range []string{"!!!", "bm90IGpzb24"} {
+		if _, err := SearchVideos(VideoQuery{Sort: "name", Limit: 10, Cursor: cursor}); err == nil {
+			t.Errorf("SearchVideos(cursor=%q) succeeded, want error", cursor)
+		}
+	}
+}
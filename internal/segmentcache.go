@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+)
+
+// segmentMeta is the sidecar written next to every cached segment
+// (segment_N.ts.json). A segment is served from cache only if its sidecar
+// exists and matches both the file on disk and the encode we would do now.
+type segmentMeta struct {
+	Size     int64   `json:"size"`
+	Start    float64 `json:"start"`
+	Duration float64 `json:"duration"`
+	Params   string  `json:"params"` // encoder settings, "copy" for a remux
+}
+
+func segmentMetaPath(segmentPath string) string {
+	return segmentPath + ".json"
+}
+
+func readSegmentMeta(segmentPath string) (*segmentMeta, error) {
+	data, err := os.ReadFile(segmentMetaPath(segmentPath))
+	if err != nil {
+		return nil, err
+	}
+	var meta segmentMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// segmentValid reports whether segmentPath holds a complete segment spanning
+// start..start+duration, encoded with one of the accepted params.
+func segmentValid(segmentPath string, start, duration float64, accepted ...string) bool {
+	info, err := os.Stat(segmentPath)
+	if err != nil || info.Size() == 0 {
+		return false
+	}
+	meta, err := readSegmentMeta(segmentPath)
+	if err != nil || meta.Size != info.Size() {
+		return false
+	}
+	if math.Abs(meta.Start-start) > 0.001 || math.Abs(meta.Duration-duration) > 0.001 {
+		return false
+	}
+	for _, p := range accepted {
+		if meta.Params == p {
+			return true
+		}
+	}
+	return false
+}
+
+// commitSegment moves a finished temporary file into place and writes its
+// sidecar. Until the rename the segment is invisible, so a crash or a killed
+// ffmpeg can never leave a truncated segment that looks valid.
+// Returns the bytes used on disk by segment and sidecar.
+func commitSegment(tmpPath, segmentPath string, start, duration float64, params string) (int64, error) {
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() == 0 {
+		os.Remove(tmpPath)
+		return 0, os.ErrInvalid
+	}
+
+	// Drop the old sidecar first: a crash in between leaves a segment without
+	// sidecar, which is regenerated, never a stale sidecar that looks valid
+	os.Remove(segmentMetaPath(segmentPath))
+	if err := os.Rename(tmpPath, segmentPath); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+
+	data, err := json.Marshal(segmentMeta{Size: info.Size(), Start: start, Duration: duration, Params: params})
+	if err != nil {
+		return 0, err
+	}
+	metaTmp := segmentMetaPath(segmentPath) + ".tmp"
+	if err := os.WriteFile(metaTmp, data, 0644); err != nil {
+		os.Remove(metaTmp)
+		return 0, err
+	}
+	if err := os.Rename(metaTmp, segmentMetaPath(segmentPath)); err != nil {
+		return 0, err
+	}
+	return info.Size() + int64(len(data)), nil
+}
@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Episode is a video recognized as an episode of a series.
+type Episode struct {
+	VideoID    string  `json:"video_id"`
+	SeriesID   string  `json:"series_id"`
+	Season     int     `json:"season"`
+	Episode    int     `json:"episode"`
+	EpisodeEnd int     `json:"episode_end,omitempty"` // multi-episode files, S01E01-E02
+	Title      string  `json:"title,omitempty"`
+	Name       string  `json:"name"` // video name
+	Duration   float64 `json:"duration"`
+}
+
+// Series groups the episodes of one show.
+type Series struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Seasons  []int  `json:"seasons"`
+	Episodes int    `json:"episodes"`
+}
+
+var (
+	// Show.S02E05.Title, Show - s2e5, S02E05E06, S02E05-06
+	reSxxEyy = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])s(\d{1,2})[ ._-]?e(\d{1,3})(?:[ ._-]?(?:e|-e?)(\d{1,3}))?(?:[^0-9]|$)`)
+	// Show 1x05, 01x05-06
+	reNxNN = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(\d{1,2})x(\d{2,3})(?:-(\d{2,3}))?(?:[^0-9]|$)`)
+	// "Season 2", "Stagione 02", "S02" folders
+	reSeasonDir = regexp.MustCompile(`(?i)^(?:season|stagione|series|serie|s)[ ._-]*(\d{1,2})$`)
+	// Episode number alone, inside a season folder: "E05", "Ep 5", "Episode 05", "05 - Title"
+	reEpisodeOnly = regexp.MustCompile(`(?i)^(?:.*?[^a-z0-9])?(?:e|ep|episode|episodio)[ ._-]*(\d{1,3})(?:[^0-9]|$)|^(\d{1,3})(?:[ ._-]|$)`)
+	// Release tags ending an episode title
+	reReleaseTags = regexp.MustCompile(`(?i)[ ._-](?:\d{3,4}p|x26[45]|h\.?26[45]|hevc|web[ ._-]?(?:dl|rip)?|hdtv|bluray|brrip|dvdrip|aac|ac3|dts|proper|repack|multi|ita|eng)(?:[ ._-]|$).*$`)
+)
+
+// parseEpisode recognizes a series episode from file and folder names.
+// Returns the show name, season, episode and episode title.
+func parseEpisode(path string) (show string, season, episode, episodeEnd int, title string, ok bool) {
+	base := nameWithoutExt(path)
+	dir := filepath.Dir(path)
+	folder := filepath.Base(dir)
+
+	// The show is in the folder name when the file name has only the episode
+	showFolder := folder
+	folderSeason := 0
+	if m := reSeasonDir.FindStringSubmatch(folder); m != nil {
+		folderSeason, _ = strconv.Atoi(m[1])
+		showFolder = filepath.Base(filepath.Dir(dir))
+	}
+	if filepath.Dir(path) == videoDir || (folderSeason > 0 && filepath.Dir(dir) == videoDir) {
+		showFolder = ""
+	}
+
+	var rest string
+	if loc := reSxxEyy.FindStringSubmatchIndex(base); loc != nil {
+		season, episode, episodeEnd = submatchInt(base, loc, 1), submatchInt(base, loc, 2), submatchInt(base, loc, 3)
+		show, rest = base[:loc[0]], base[loc[1]:]
+	} else if loc := reNxNN.FindStringSubmatchIndex(base); loc != nil {
+		season, episode, episodeEnd = submatchInt(base, loc, 1), submatchInt(base, loc, 2), submatchInt(base, loc, 3)
+		show, rest = base[:loc[0]], base[loc[1]:]
+	} else if folderSeason > 0 {
+		loc := reEpisodeOnly.FindStringSubmatchIndex(base)
+		if loc == nil {
+			return "", 0, 0, 0, "", false
+		}
+		season = folderSeason
+		episode = submatchInt(base, loc, 1)
+		if episode == 0 {
+			episode = submatchInt(base, loc, 2)
+		}
+		rest = base[loc[1]:]
+	} else {
+		return "", 0, 0, 0, "", false
+	}
+	if episode == 0 {
+		return "", 0, 0, 0, "", false
+	}
+	if episodeEnd <= episode {
+		episodeEnd = 0
+	}
+
+	show = cleanReleaseName(show)
+	if show == "" {
+		show = cleanReleaseName(showFolder)
+	}
+	if show == "" {
+		return "", 0, 0, 0, "", false
+	}
+	title = cleanReleaseName(reReleaseTags.ReplaceAllString(" "+rest, ""))
+	return show, season, episode, episodeEnd, title, true
+}
+
+// submatchInt returns group n of a FindStringSubmatchIndex match as a number, 0 if missing.
+func submatchInt(s string, loc []int, n int) int {
+	if loc[2*n] < 0 {
+		return 0
+	}
+	v, _ := strconv.Atoi(s[loc[2*n]:loc[2*n+1]])
+	return v
+}
+
+// cleanReleaseName turns "The.Show_Name -" into "The Show Name".
+func cleanReleaseName(s string) string {
+	s = strings.NewReplacer(".", " ", "_", " ").Replace(s)
+	return strings.Trim(strings.Join(strings.Fields(s), " "), " -[]()")
+}
+
+// seriesID is a readable ID stable across scans: the folded show name.
+func seriesID(show string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range foldText(show) {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// libraryEpisodes returns every episode in the library, by series ID, sorted
+// by season and episode, and the series names.
+func libraryEpisodes() (map[string][]Episode, map[string]string) {
+	episodes := make(map[string][]Episode)
+	names := make(map[string]string)
+	for _, v := range GetVideos() {
+		show, season, episode, episodeEnd, title, ok := parseEpisode(v.Path)
+		if !ok {
+			continue
+		}
+		id := seriesID(show)
+		if id == "" {
+			continue
+		}
+		if _, ok := names[id]; !ok {
+			names[id] = show
+		}
+		episodes[id] = append(episodes[id], Episode{
+			VideoID:    v.ID,
+			SeriesID:   id,
+			Season:     season,
+			Episode:    episode,
+			EpisodeEnd: episodeEnd,
+			Title:      title,
+			Name:       v.Name,
+			Duration:   v.Duration,
+		})
+	}
+	for _, eps := range episodes {
+		sort.Slice(eps, func(i, j int) bool {
+			if eps[i].Season != eps[j].Season {
+				return eps[i].Season < eps[j].Season
+			}
+			if eps[i].Episode != eps[j].Episode {
+				return eps[i].Episode < eps[j].Episode
+			}
+			return eps[i].Name < eps[j].Name
+		})
+	}
+	return episodes, names
+}
+
+func seasonsOf(eps []Episode) []int {
+	seasons := []int{}
+	for _, ep := range eps {
+		if len(seasons) == 0 || seasons[len(seasons)-1] != ep.Season {
+			seasons = append(seasons, ep.Season)
+		}
+	}
+	return seasons
+}
+
+// NextEpisode returns the episode after a video: the next one of its
+// season, or the first of the next season.
+func NextEpisode(videoID string) (*Episode, bool) {
+	episodes, _ := libraryEpisodes()
+	for _, eps := range episodes {
+		for i, ep := range eps {
+			if ep.VideoID != videoID {
+				continue
+			}
+			last := max(ep.Episode, ep.EpisodeEnd)
+			for _, next := range eps[i+1:] {
+				// Skip other versions of the same episode
+				if next.Season > ep.Season || next.Episode > last {
+					return &next, true
+				}
+			}
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+// GET /series
+func HandleSeriesList(c *gin.Context) {
+	episodes, names := libraryEpisodes()
+	list := make([]Series, 0, len(episodes))
+	for id, eps := range episodes {
+		list = append(list, Series{ID: id, Name: names[id], Seasons: seasonsOf(eps), Episodes: len(eps)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	c.JSON(200, list)
+}
+
+// GET /series/:id
+func HandleSeries(c *gin.Context) {
+	episodes, names := libraryEpisodes()
+	id := c.Param("id")
+	eps, ok := episodes[id]
+	if !ok {
+		c.String(404, "series not found")
+		return
+	}
+	c.JSON(200, Series{ID: id, Name: names[id], Seasons: seasonsOf(eps), Episodes: len(eps)})
+}
+
+// GET /series/:id/seasons/:n
+func HandleSeason(c *gin.Context) {
+	episodes, names := libraryEpisodes()
+	id := c.Param("id")
+	season, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		c.String(400, "invalid season")
+		return
+	}
+
+	list := []Episode{}
+	for _, ep := range episodes[id] {
+		if ep.Season == season {
+			list = append(list, ep)
+		}
+	}
+	if len(list) == 0 {
+		c.String(404, "season not found")
+		return
+	}
+	c.JSON(200, gin.H{"series_id": id, "name": names[id], "season": season, "episodes": list})
+}
+
+// GET /episodes/:id/next
+func HandleNextEpisode(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	next, isEpisode := NextEpisode(video.ID)
+	switch {
+	case !isEpisode:
+		c.String(404, "not an episode")
+	case next == nil:
+		c.String(404, "last episode")
+	default:
+		c.JSON(200, next)
+	}
+}
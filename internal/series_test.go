@@ -0,0 +1,68 @@
+package internal
+
+import "testing"
+
+func TestParseEpisode(t *testing.T) {
+	tests := []struct {
+		path                string
+		show                string
+		season, episode, to int
+		title               string
+		ok                  bool
+	}{
+		{"/video/Show/The.Show.S02E05.Pilot.720p.WEB-DL.mkv", "The Show", 2, 5, 0, "Pilot", true},
+		{"/video/Show - s2e5 - Title.mkv", "Show", 2, 5, 0, "Title", true},
+		{"/video/Show.S01E01E02.mkv", "Show", 1, 1, 2, "", true},
+		{"/video/Show.S01E01-02.mkv", "Show", 1, 1, 2, "", true},
+		{"/video/Show.S01E01-E02.mkv", "Show", 1, 1, 2, "", true},
+		{"/video/Show 1x05.mkv", "Show", 1, 5, 0, "", true},
+		{"/video/Show 01x05-06 Title.mkv", "Show", 1, 5, 6, "Title", true},
+		{"/video/Better Show/S03E10.mkv", "Better Show", 3, 10, 0, "", true},
+		{"/video/Show/Season 2/E05.mkv", "Show", 2, 5, 0, "", true},
+		{"/video/Show/Stagione 02/Ep 7 - Finale.mkv", "Show", 2, 7, 0, "Finale", true},
+		{"/video/Show/S01/05 - Title.mkv", "Show", 1, 5, 0, "Title", true},
+		{"/video/Show/Season 1/Episode 03.mkv", "Show", 1, 3, 0, "", true},
+		// Not episodes
+		{"/video/Movie (2010).mkv", "", 0, 0, 0, "", false},
+		{"/video/Movies/Mission.Impossible.mkv", "", 0, 0, 0, "", false},
+		{"/video/Show/Random 05.mkv", "", 0, 0, 0, "", false},
+		{"/video/Season 1/E05.mkv", "", 0, 0, 0, "", false}, // no show name anywhere
+		{"/video/Show.S01E00.mkv", "", 0, 0, 0, "", false},
+		{"/video/1920x1080.mkv", "", 0, 0, 0, "", false},
+	}
+	for _, tt := range tests {
+		show, season, episode, to, title, ok := parseEpisode(tt.path)
+		if ok != tt.ok || show != tt.show || season != tt.season || episode != tt.episode || to != tt.to || title != tt.title {
+			t.Errorf("parseEpisode(%q) = %q, %d, %d, %d, %q, %v; want %q, %d, %d, %d, %q, %v",
+				tt.path, show, season, episode, to, title, ok,
+				tt.show, tt.season, tt.episode, tt.to, tt.title, tt.ok)
+		}
+	}
+}
+
+func TestCleanReleaseName(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"The.Show_Name -", "The Show Name"},
+		{"  Show  ", "Show"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := cleanReleaseName(tt.in); got != tt.want {
+			t.Errorf("cleanReleaseName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSeriesID(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"The Show", "the-show"},
+		{"Amélie's Show!", "amelie-s-show"},
+		{"  Show  2 ", "show-2"},
+		{"!!!", ""},
+	}
+	for _, tt := range tests {
+		if got := seriesID(tt.in); got != tt.want {
+			t.Errorf("seriesID(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
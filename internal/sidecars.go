@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/language"
+)
+
+// SidecarSubtitle is a subtitle file next to a video and named after it:
+// Movie.srt, Movie.it.srt, Movie.en.forced.ass, Movie.ita.sdh.vtt.
+type SidecarSubtitle struct {
+	Path     string `json:"path"`
+	Format   string `json:"format"` // srt, ass, ssa, vtt
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"` // the rest of the name, e.g. "SDH"
+	Forced   bool   `json:"forced,omitempty"`
+	Size     int64  `json:"size"`
+	ModTime  int64  `json:"mtime"` // unix nanoseconds
+}
+
+// findSidecars returns the subtitle files of a video, sorted by name.
+// With Movie.mkv and Movie.Part2.mkv in the same folder, Movie.Part2.srt
+// belongs to the second one: the longest matching video name wins.
+func findSidecars(videoPath string) []SidecarSubtitle {
+	dir := filepath.Dir(videoPath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	base := nameWithoutExt(videoPath)
+	var videos []string
+	for _, e := range entries {
+		if !e.IsDir() && isVideo(e.Name()) {
+			videos = append(videos, nameWithoutExt(e.Name()))
+		}
+	}
+
+	var sidecars []SidecarSubtitle
+	for _, e := range entries {
+		if e.IsDir() || !isSubtitle(e.Name()) {
+			continue
+		}
+		stem := nameWithoutExt(e.Name())
+		if !sidecarOf(stem, base) {
+			continue
+		}
+		owned := true
+		for _, other := range videos {
+			if len(other) > len(base) && sidecarOf(stem, other) {
+				owned = false
+				break
+			}
+		}
+		info, err := e.Info()
+		if !owned || err != nil {
+			continue
+		}
+		sc := SidecarSubtitle{
+			Path:    filepath.Join(dir, e.Name()),
+			Format:  strings.ToLower(strings.TrimPrefix(filepath.Ext(e.Name()), ".")),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+		}
+		parseSidecarTags(&sc, stem[len(base):])
+		sidecars = append(sidecars, sc)
+	}
+	return sidecars
+}
+
+// sidecarOf reports whether a subtitle file name (without extension) is
+// the video name, alone or followed by dot-separated tags.
+func sidecarOf(stem, video string) bool {
+	if len(stem) < len(video) || !strings.EqualFold(stem[:len(video)], video) {
+		return false
+	}
+	return len(stem) == len(video) || stem[len(video)] == '.'
+}
+
+// parseSidecarTags reads the tags after the video name: a language (ISO
+// 639-1 or 639-2), "forced", anything else goes in the title.
+func parseSidecarTags(sc *SidecarSubtitle, tags string) {
+	var title []string
+	for _, tag := range strings.Split(strings.Trim(tags, "."), ".") {
+		lower := strings.ToLower(tag)
+		switch {
+		case tag == "":
+		case lower == "forced":
+			sc.Forced = true
+		case lower == "sdh" || lower == "cc":
+			title = append(title, strings.ToUpper(tag))
+		case sc.Language == "" && isLanguageTag(lower):
+			sc.Language = lower
+		default:
+			title = append(title, tag)
+		}
+	}
+	sc.Title = strings.Join(title, " ")
+}
+
+func isLanguageTag(s string) bool {
+	if len(s) < 2 || len(s) > 3 {
+		return false
+	}
+	tag, err := language.Parse(s)
+	return err == nil && tag != language.Und
+}
+
+// RefreshSidecars looks again for the subtitle files of the videos in a
+// folder and returns the videos whose list changed.
+func RefreshSidecars(dir string) []VideoData {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	var changed []VideoData
+	result := make([]VideoData, len(videoCache))
+	copy(result, videoCache)
+	for i, v := range result {
+		if filepath.Dir(v.Path) != dir {
+			continue
+		}
+		sidecars := findSidecars(v.Path)
+		if !reflect.DeepEqual(sidecars, v.Sidecars) {
+			result[i].Sidecars = sidecars
+			changed = append(changed, result[i])
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	saveChanges(changed, nil)
+	setVideoCacheLocked(result)
+	return changed
+}
+
+// sidecarFile is the converted copy of a sidecar, named after its path, size
+// and mtime: an edited file gets converted again.
+func sidecarFile(sc SidecarSubtitle, ext string) string {
+	key := xxhash.Sum64String(fmt.Sprintf("%s|%d|%d", sc.Path, sc.Size, sc.ModTime))
+	return filepath.Join(subtitlesDir, "sidecars", strconv.FormatUint(key, 16)+"."+ext)
+}
+
+// convertSidecar writes a sidecar as UTF-8 in format, "webvtt" or "ass". A
+// file already in that format only needs the re-encoding, the others go
+// through ffmpeg.
+func convertSidecar(ctx context.Context, sc SidecarSubtitle, out, format string) error {
+	raw, err := os.ReadFile(sc.Path)
+	if err != nil {
+		return err
+	}
+	text, charset, err := decodeSubtitle(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %w", charset, err)
+	}
+	if charset != "utf-8" {
+		fmt.Printf("[subtitles] %s read as %s\n", sc.Path, charset)
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+
+	tmp := out + ".tmp"
+	defer os.Remove(tmp)
+	if sc.Format == "vtt" && format == "webvtt" || sc.Format == "ass" && format == "ass" {
+		if err := os.WriteFile(tmp, []byte(text), 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmp, out)
+	}
+
+	// ffmpeg picks the demuxer from the extension
+	src := out + ".src." + sc.Format
+	defer os.Remove(src)
+	if err := os.WriteFile(src, []byte(text), 0644); err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-v", "error",
+		"-i", src,
+		"-c:s", format,
+		"-f", format,
+		"-y", tmp,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return os.Rename(tmp, out)
+}
+
+// decodeSubtitle returns the text of a subtitle file as UTF-8 and the
+// charset it was read as. Without a BOM, a file that is not valid UTF-8 is
+// legacy 8-bit: Windows-1252 for most Italian releases, ISO-8859-15 when
+// the euro sign is where 8859-15 has it and 1252 bytes are absent.
+func decodeSubtitle(data []byte) (string, string, error) {
+	var enc encoding.Encoding
+	var charset string
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return string(data[3:]), "utf-8", nil
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		enc, charset = unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM), "utf-16le"
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		enc, charset = unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), "utf-16be"
+	case utf8.Valid(data):
+		return string(data), "utf-8", nil
+	case !hasWindows1252Bytes(data) && bytes.IndexByte(data, 0xA4) >= 0:
+		enc, charset = charmap.ISO8859_15, "iso-8859-15"
+	default:
+		enc, charset = charmap.Windows1252, "windows-1252"
+	}
+	out, err := enc.NewDecoder().Bytes(data)
+	return string(out), charset, err
+}
+
+// hasWindows1252Bytes reports whether data uses 0x80-0x9F, control codes in
+// ISO-8859 and letters and punctuation in Windows-1252.
+func hasWindows1252Bytes(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 && b <= 0x9F {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSidecarOf(t *testing.T) {
+	tests := []struct {
+		stem, video string
+		want        bool
+	}{
+		{"Movie", "Movie", true},
+		{"Movie.it", "Movie", true},
+		{"movie.EN.forced", "Movie", true},
+		{"Movie.Part2", "Movie", true}, // ownership is settled by findSidecars
+		{"Movie2", "Movie", false},
+		{"Movie 2", "Movie", false},
+		{"Mov", "Movie", false},
+		{"Other.it", "Movie", false},
+	}
+	for _, tt := range tests {
+		if got := sidecarOf(tt.stem, tt.video); got != tt.want {
+			t.Errorf("sidecarOf(%q, %q) = %v, want %v", tt.stem, tt.video, got, tt.want)
+		}
+	}
+}
+
+func TestParseSidecarTags(t *testing.T) {
+	tests := []struct {
+		tags string
+		want SidecarSubtitle
+	}{
+		{"", SidecarSubtitle{}},
+		{".it", SidecarSubtitle{Language: "it"}},
+		{".ITA", SidecarSubtitle{Language: "ita"}},
+		{".en.forced", SidecarSubtitle{Language: "en", Forced: true}},
+		{".ita.sdh", SidecarSubtitle{Language: "ita", Title: "SDH"}},
+		{".en.cc", SidecarSubtitle{Language: "en", Title: "CC"}},
+		{".Director Commentary", SidecarSubtitle{Title: "Director Commentary"}},
+		{".it.en", SidecarSubtitle{Language: "it", Title: "en"}}, // first language wins
+		{"..forced..", SidecarSubtitle{Forced: true}},
+	}
+	for _, tt := range tests {
+		var got SidecarSubtitle
+		parseSidecarTags(&got, tt.tags)
+		if got != tt.want {
+			t.Errorf("parseSidecarTags(%q) = %+v, want %+v", tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestFindSidecars(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"Movie.mkv", "Movie.Part2.mkv",
+		"Movie.srt", "Movie.it.srt", "Movie.Part2.en.srt", "Movie.txt", "Other.srt",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		video string
+		want  []string
+	}{
+		{"Movie.mkv", []string{"Movie.it.srt", "Movie.srt"}},
+		{"Movie.Part2.mkv", []string{"Movie.Part2.en.srt"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, sc := range findSidecars(filepath.Join(dir, tt.video)) {
+			got = append(got, filepath.Base(sc.Path))
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("findSidecars(%s) = %v, want %v", tt.video, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("findSidecars(%s) = %v, want %v", tt.video, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestDecodeSubtitle(t *testing.T) {
+	tests := []struct {
+		name        string
+		in          []byte
+		want        string
+		wantCharset string
+	}{
+		{"utf-8", []byte("perché"), "perché", "utf-8"},
+		{"utf-8 BOM", []byte("\xEF\xBB\xBFciao"), "ciao", "utf-8"},
+		{"utf-16le BOM", []byte{0xFF, 0xFE, 'h', 0, 0xE8, 0}, "hè", "utf-16le"},
+		{"utf-16be BOM", []byte{0xFE, 0xFF, 0, 'h', 0, 0xE8}, "hè", "utf-16be"},
+		{"latin accents", []byte("perch\xE9"), "perché", "windows-1252"},
+		{"windows-1252 quotes", []byte("\x93ciao\x94 \xA4"), "“ciao” ¤", "windows-1252"},
+		{"iso-8859-15 euro", []byte("10 \xA4"), "10 €", "iso-8859-15"},
+		{"empty", nil, "", "utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, charset, err := decodeSubtitle(tt.in)
+			if err != nil {
+				t.Fatalf("decodeSubtitle() error = %v", err)
+			}
+			if got != tt.want || charset != tt.wantCharset {
+				t.Errorf("decodeSubtitle() = %q, %q, want %q, %q", got, charset, tt.want, tt.wantCharset)
+			}
+		})
+	}
+}
@@ -0,0 +1,409 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// LibraryStore persists the video library. The in-memory videoCache is the
+// read path; a store only sees the changes.
+type LibraryStore interface {
+	// Videos returns every stored video.
+	Videos() ([]VideoData, error)
+	// Video returns a video by ID or by one of its aliases.
+	Video(id string) (VideoData, bool, error)
+	// VideoByPath returns the video listed at path; merged copies do not count.
+	VideoByPath(path string) (VideoData, bool, error)
+	// VideosByFingerprint returns the videos with that content fingerprint.
+	VideosByFingerprint(fingerprint string) ([]VideoData, error)
+	// PutVideos inserts or replaces videos by ID.
+	PutVideos(videos ...VideoData) error
+	// DeleteVideos removes videos by ID, unknown IDs are ignored.
+	DeleteVideos(ids ...string) error
+
+	// Collections returns every collection.
+	Collections() ([]Collection, error)
+	// PutCollection inserts or replaces a collection by ID.
+	PutCollection(col Collection) error
+	// DeleteCollection removes a collection, an unknown ID is ignored.
+	DeleteCollection(id string) error
+
+	// Progress returns the watch progress of every user.
+	Progress() ([]WatchProgress, error)
+	// PutProgress inserts or replaces the progress of a user on a video.
+	PutProgress(p WatchProgress) error
+	// DeleteProgress removes the progress of a user on a video, if any.
+	DeleteProgress(userID, videoID string) error
+
+	// Users returns every account.
+	Users() ([]User, error)
+	// PutUser inserts or replaces an account by ID.
+	PutUser(u User) error
+	// DeleteUser removes an account with its sessions and watch progress.
+	DeleteUser(id int64) error
+	// Sessions returns every login session, expired ones included.
+	Sessions() ([]Session, error)
+	// PutSession inserts a session.
+	PutSession(s Session) error
+	// DeleteSessions removes sessions by token hash, unknown ones are ignored.
+	DeleteSessions(tokenHashes ...string) error
+
+	Close() error
+}
+
+// library is the store opened by LoadAndSyncVideos.
+var library LibraryStore
+
+// openLibraryStore opens the store selected by GAZEPARTY_STORE: "sqlite"
+// (default, /data/library.db) or "json" (/data/videos.json, collections.json,
+// progress.json and auth.json).
+func openLibraryStore() (LibraryStore, error) {
+	switch kind := os.Getenv("GAZEPARTY_STORE"); kind {
+	case "", "sqlite":
+		return openSQLiteStore(sqliteFile, dataFile)
+	case "json":
+		return openJSONStore(dataFile, collectionsFile, progressFile, authFile)
+	default:
+		return nil, fmt.Errorf("unknown GAZEPARTY_STORE %q (sqlite, json)", kind)
+	}
+}
+
+// jsonStore keeps the library in a single JSON file, rewritten on every
+// change; collections, watch progress and accounts go in their own files.
+type jsonStore struct {
+	mu              sync.Mutex
+	path            string
+	videos          []VideoData
+	collectionsPath string
+	collections     []Collection
+	progressPath    string
+	progress        []WatchProgress
+	authPath        string
+	auth            jsonAuth
+}
+
+// jsonAuth is the content of auth.json.
+type jsonAuth struct {
+	Users    []User    `json:"users"`
+	Sessions []Session `json:"sessions"`
+}
+
+func openJSONStore(path, collectionsPath, progressPath, authPath string) (*jsonStore, error) {
+	videos, err := readVideosFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var collections []Collection
+	if err := readJSONFile(collectionsPath, &collections); err != nil {
+		return nil, err
+	}
+	var progress []WatchProgress
+	if err := readJSONFile(progressPath, &progress); err != nil {
+		return nil, err
+	}
+	var auth jsonAuth
+	if err := readJSONFile(authPath, &auth); err != nil {
+		return nil, err
+	}
+	fmt.Printf("[data] json store: %d videos from %s\n", len(videos), path)
+	return &jsonStore{path: path, videos: videos, collectionsPath: collectionsPath, collections: collections,
+		progressPath: progressPath, progress: progress, authPath: authPath, auth: auth}, nil
+}
+
+func (s *jsonStore) Videos() ([]VideoData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]VideoData(nil), s.videos...), nil
+}
+
+func (s *jsonStore) Video(id string) (VideoData, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.videos {
+		if v.ID == id || containsString(v.Aliases, id) {
+			return v, true, nil
+		}
+	}
+	return VideoData{}, false, nil
+}
+
+func (s *jsonStore) VideoByPath(path string) (VideoData, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.videos {
+		if v.Path == path {
+			return v, true, nil
+		}
+	}
+	return VideoData{}, false, nil
+}
+
+func (s *jsonStore) VideosByFingerprint(fingerprint string) ([]VideoData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var videos []VideoData
+	for _, v := range s.videos {
+		if v.Fingerprint == fingerprint {
+			videos = append(videos, v)
+		}
+	}
+	return videos, nil
+}
+
+func (s *jsonStore) PutVideos(videos ...VideoData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range videos {
+		replaced := false
+		for i := range s.videos {
+			if s.videos[i].ID == v.ID {
+				s.videos[i] = v
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			s.videos = append(s.videos, v)
+		}
+	}
+	return s.saveLocked()
+}
+
+func (s *jsonStore) DeleteVideos(ids ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	drop := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		drop[id] = true
+	}
+	kept := s.videos[:0]
+	for _, v := range s.videos {
+		if !drop[v.ID] {
+			kept = append(kept, v)
+		}
+	}
+	s.videos = kept
+	return s.saveLocked()
+}
+
+func (s *jsonStore) Collections() ([]Collection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Collection(nil), s.collections...), nil
+}
+
+func (s *jsonStore) PutCollection(col Collection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.collections {
+		if s.collections[i].ID == col.ID {
+			s.collections[i] = col
+			return writeJSONFile(s.collectionsPath, s.collections)
+		}
+	}
+	s.collections = append(s.collections, col)
+	return writeJSONFile(s.collectionsPath, s.collections)
+}
+
+func (s *jsonStore) DeleteCollection(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.collections {
+		if s.collections[i].ID == id {
+			s.collections = append(s.collections[:i], s.collections[i+1:]...)
+			return writeJSONFile(s.collectionsPath, s.collections)
+		}
+	}
+	return nil
+}
+
+func (s *jsonStore) Progress() ([]WatchProgress, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]WatchProgress(nil), s.progress...), nil
+}
+
+func (s *jsonStore) PutProgress(p WatchProgress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.progress {
+		if s.progress[i].UserID == p.UserID && s.progress[i].VideoID == p.VideoID {
+			s.progress[i] = p
+			return writeJSONFile(s.progressPath, s.progress)
+		}
+	}
+	s.progress = append(s.progress, p)
+	return writeJSONFile(s.progressPath, s.progress)
+}
+
+func (s *jsonStore) DeleteProgress(userID, videoID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.progress {
+		if s.progress[i].UserID == userID && s.progress[i].VideoID == videoID {
+			s.progress = append(s.progress[:i], s.progress[i+1:]...)
+			return writeJSONFile(s.progressPath, s.progress)
+		}
+	}
+	return nil
+}
+
+func (s *jsonStore) Users() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]User(nil), s.auth.Users...), nil
+}
+
+func (s *jsonStore) PutUser(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.auth.Users {
+		if s.auth.Users[i].ID == u.ID {
+			s.auth.Users[i] = u
+			return s.saveAuthLocked()
+		}
+	}
+	s.auth.Users = append(s.auth.Users, u)
+	return s.saveAuthLocked()
+}
+
+func (s *jsonStore) DeleteUser(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keptUsers := s.auth.Users[:0]
+	for _, u := range s.auth.Users {
+		if u.ID != id {
+			keptUsers = append(keptUsers, u)
+		}
+	}
+	s.auth.Users = keptUsers
+	keptSessions := s.auth.Sessions[:0]
+	for _, sess := range s.auth.Sessions {
+		if sess.UserID != id {
+			keptSessions = append(keptSessions, sess)
+		}
+	}
+	s.auth.Sessions = keptSessions
+	if err := s.saveAuthLocked(); err != nil {
+		return err
+	}
+
+	userID := userKey(id)
+	keptProgress := s.progress[:0]
+	for _, p := range s.progress {
+		if p.UserID != userID {
+			keptProgress = append(keptProgress, p)
+		}
+	}
+	s.progress = keptProgress
+	return writeJSONFile(s.progressPath, s.progress)
+}
+
+func (s *jsonStore) Sessions() ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Session(nil), s.auth.Sessions...), nil
+}
+
+func (s *jsonStore) PutSession(sess Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Expired sessions go when a new one comes
+	now := time.Now()
+	kept := s.auth.Sessions[:0]
+	for _, old := range s.auth.Sessions {
+		if old.ExpiresAt.After(now) {
+			kept = append(kept, old)
+		}
+	}
+	s.auth.Sessions = append(kept, sess)
+	return s.saveAuthLocked()
+}
+
+func (s *jsonStore) DeleteSessions(tokenHashes ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	drop := make(map[string]bool, len(tokenHashes))
+	for _, h := range tokenHashes {
+		drop[h] = true
+	}
+	kept := s.auth.Sessions[:0]
+	for _, sess := range s.auth.Sessions {
+		if !drop[sess.TokenHash] {
+			kept = append(kept, sess)
+		}
+	}
+	s.auth.Sessions = kept
+	return s.saveAuthLocked()
+}
+
+func (s *jsonStore) Close() error { return nil }
+
+func (s *jsonStore) saveLocked() error {
+	return writeJSONFile(s.path, s.videos)
+}
+
+// saveAuthLocked writes auth.json readable by the owner only: it holds
+// password hashes.
+func (s *jsonStore) saveAuthLocked() error {
+	return writeJSONFileMode(s.authPath, s.auth, 0600)
+}
+
+// readVideosFile reads a videos.json, a missing file is an empty library.
+func readVideosFile(path string) ([]VideoData, error) {
+	var videos []VideoData
+	err := readJSONFile(path, &videos)
+	return videos, err
+}
+
+// readJSONFile decodes a JSON file into v; a missing file leaves v untouched.
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeJSONFile replaces a JSON file through a temporary file.
+func writeJSONFile(path string, v any) error {
+	return writeJSONFileMode(path, v, 0644)
+}
+
+// writeJSONFileMode is writeJSONFile with the permissions of the new file.
+// The temporary file is created with them, so the content is never exposed
+// with wider ones.
+func writeJSONFileMode(path string, v any, perm os.FileMode) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	// A leftover tmp would keep its own mode
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,582 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteFile = "/data/library.db"
+
+// migrations are applied in order; PRAGMA user_version is the number applied.
+// Never edit an entry once released, append a new one.
+var migrations = []string{
+	// 1: library
+	`CREATE TABLE videos (
+		id       TEXT PRIMARY KEY,
+		path     TEXT NOT NULL,
+		name     TEXT NOT NULL,
+		size     INTEGER NOT NULL,
+		mtime    INTEGER NOT NULL,
+		inode    INTEGER NOT NULL,
+		duration REAL NOT NULL,
+		info     TEXT NOT NULL -- MediaInfo as JSON
+	);
+	CREATE INDEX videos_path ON videos(path);`,
+
+	// 2: users and login sessions
+	`CREATE TABLE users (
+		id            INTEGER PRIMARY KEY,
+		username      TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		admin         INTEGER NOT NULL DEFAULT 0,
+		created_at    INTEGER NOT NULL
+	);
+	CREATE TABLE sessions (
+		token      TEXT PRIMARY KEY,
+		user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX sessions_user ON sessions(user_id);`,
+
+	// 3: watch progress, per viewer and video
+	`CREATE TABLE watch_progress (
+		user_id    TEXT NOT NULL,
+		video_id   TEXT NOT NULL,
+		position   REAL NOT NULL,
+		duration   REAL NOT NULL,
+		watched    INTEGER NOT NULL DEFAULT 0,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (user_id, video_id)
+	);
+	CREATE INDEX watch_progress_recent ON watch_progress(user_id, updated_at);`,
+
+	// 4: extended metadata, free key/value pairs per video
+	`CREATE TABLE video_meta (
+		video_id TEXT NOT NULL,
+		key      TEXT NOT NULL,
+		value    TEXT NOT NULL,
+		PRIMARY KEY (video_id, key)
+	);`,
+
+	// 5: stable identity: content fingerprint, merged copies and old IDs
+	`ALTER TABLE videos ADD COLUMN fingerprint TEXT NOT NULL DEFAULT '';
+	ALTER TABLE videos ADD COLUMN alt_paths TEXT NOT NULL DEFAULT '[]';
+	CREATE INDEX videos_fingerprint ON videos(fingerprint);
+	CREATE TABLE video_aliases (
+		alias    TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL
+	);
+	CREATE INDEX video_aliases_video ON video_aliases(video_id);`,
+
+	// 6: collections, ordered lists of video IDs
+	`CREATE TABLE collections (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	CREATE TABLE collection_items (
+		collection_id TEXT NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+		position      INTEGER NOT NULL,
+		video_id      TEXT NOT NULL,
+		PRIMARY KEY (collection_id, position)
+	);`,
+
+	// 7: subtitle files found next to the videos
+	`ALTER TABLE videos ADD COLUMN sidecars TEXT NOT NULL DEFAULT '[]';`,
+}
+
+// subtitleOffsetMeta prefixes the video_meta keys of subtitle offsets, one
+// per track key (see SubtitleRendition).
+const subtitleOffsetMeta = "subtitle_offset:"
+
+// sqliteStore keeps the library in an embedded SQLite database (pure Go, no cgo).
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// openSQLiteStore opens (or creates) the database, applies pending
+// migrations and, on first use, imports the old videos.json at importPath.
+func openSQLiteStore(path, importPath string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	// One writer at a time anyway, and it keeps the pragmas on a single connection
+	db.SetMaxOpenConns(1)
+
+	s := &sqliteStore{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating %s: %w", path, err)
+	}
+	if err := s.importJSON(importPath); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("importing %s: %w", importPath, err)
+	}
+	return s, nil
+}
+
+func (s *sqliteStore) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for version < len(migrations) {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+		// PRAGMA takes no placeholders
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		version++
+		fmt.Printf("[data] sqlite schema at version %d\n", version)
+	}
+	return nil
+}
+
+// importJSON loads a videos.json left by the JSON store into an empty
+// database, then renames it so the import runs only once.
+func (s *sqliteStore) importJSON(path string) error {
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM videos").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	videos, err := readVideosFile(path)
+	if err != nil || len(videos) == 0 {
+		return err
+	}
+	if err := s.PutVideos(videos...); err != nil {
+		return err
+	}
+	fmt.Printf("[data] imported %d videos from %s\n", len(videos), path)
+	return os.Rename(path, path+".imported")
+}
+
+func (s *sqliteStore) Videos() ([]VideoData, error) {
+	return s.queryVideos("")
+}
+
+func (s *sqliteStore) Video(id string) (VideoData, bool, error) {
+	return firstVideo(s.queryVideos("WHERE id = ? OR id = (SELECT video_id FROM video_aliases WHERE alias = ?)", id, id))
+}
+
+func (s *sqliteStore) VideoByPath(path string) (VideoData, bool, error) {
+	return firstVideo(s.queryVideos("WHERE path = ?", path))
+}
+
+func (s *sqliteStore) VideosByFingerprint(fingerprint string) ([]VideoData, error) {
+	return s.queryVideos("WHERE fingerprint = ?", fingerprint)
+}
+
+func firstVideo(videos []VideoData, err error) (VideoData, bool, error) {
+	if err != nil || len(videos) == 0 {
+		return VideoData{}, false, err
+	}
+	return videos[0], true, nil
+}
+
+// queryVideos returns the videos matching where (a WHERE clause on the
+// videos table, empty for all of them) with their aliases and offsets.
+func (s *sqliteStore) queryVideos(where string, args ...any) ([]VideoData, error) {
+	aliases, err := s.aliases(where, args...)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := s.subtitleOffsets(where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query("SELECT id, path, name, fingerprint, alt_paths, sidecars, size, mtime, inode, info FROM videos "+where+" ORDER BY path", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var videos []VideoData
+	for rows.Next() {
+		var v VideoData
+		var inode int64
+		var altPaths, sidecars, info string
+		if err := rows.Scan(&v.ID, &v.Path, &v.Name, &v.Fingerprint, &altPaths, &sidecars, &v.Size, &v.ModTime, &inode, &info); err != nil {
+			return nil, err
+		}
+		v.Inode = uint64(inode)
+		v.Aliases = aliases[v.ID]
+		v.SubtitleOffsets = offsets[v.ID]
+		if err := json.Unmarshal([]byte(altPaths), &v.AltPaths); err != nil {
+			return nil, fmt.Errorf("video %s: %w", v.ID, err)
+		}
+		if err := json.Unmarshal([]byte(sidecars), &v.Sidecars); err != nil {
+			return nil, fmt.Errorf("video %s: %w", v.ID, err)
+		}
+		// As a scan finding none leaves them
+		if len(v.AltPaths) == 0 {
+			v.AltPaths = nil
+		}
+		if len(v.Sidecars) == 0 {
+			v.Sidecars = nil
+		}
+		if err := json.Unmarshal([]byte(info), &v.MediaInfo); err != nil {
+			return nil, fmt.Errorf("video %s: %w", v.ID, err)
+		}
+		videos = append(videos, v)
+	}
+	return videos, rows.Err()
+}
+
+// aliases returns the old IDs of the videos matching where, by video ID.
+func (s *sqliteStore) aliases(where string, args ...any) (map[string][]string, error) {
+	rows, err := s.db.Query("SELECT alias, video_id FROM video_aliases WHERE video_id IN (SELECT id FROM videos "+where+") ORDER BY alias", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := make(map[string][]string)
+	for rows.Next() {
+		var alias, id string
+		if err := rows.Scan(&alias, &id); err != nil {
+			return nil, err
+		}
+		aliases[id] = append(aliases[id], alias)
+	}
+	return aliases, rows.Err()
+}
+
+// subtitleOffsets returns the subtitle offsets of the videos matching where,
+// by video ID.
+func (s *sqliteStore) subtitleOffsets(where string, args ...any) (map[string]map[string]float64, error) {
+	rows, err := s.db.Query("SELECT video_id, key, value FROM video_meta WHERE key GLOB ? AND video_id IN (SELECT id FROM videos "+where+")",
+		append([]any{subtitleOffsetMeta + "*"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	offsets := make(map[string]map[string]float64)
+	for rows.Next() {
+		var id, key, value string
+		if err := rows.Scan(&id, &key, &value); err != nil {
+			return nil, err
+		}
+		offset, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("video %s, %s: %w", id, key, err)
+		}
+		if offsets[id] == nil {
+			offsets[id] = make(map[string]float64)
+		}
+		offsets[id][strings.TrimPrefix(key, subtitleOffsetMeta)] = offset
+	}
+	return offsets, rows.Err()
+}
+
+func (s *sqliteStore) PutVideos(videos ...VideoData) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO videos (id, path, name, fingerprint, alt_paths, sidecars, size, mtime, inode, duration, info)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET path = excluded.path, name = excluded.name,
+			fingerprint = excluded.fingerprint, alt_paths = excluded.alt_paths, sidecars = excluded.sidecars,
+			size = excluded.size, mtime = excluded.mtime, inode = excluded.inode,
+			duration = excluded.duration, info = excluded.info`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, v := range videos {
+		info, err := json.Marshal(v.MediaInfo)
+		if err != nil {
+			return err
+		}
+		altPaths, err := json.Marshal(v.AltPaths)
+		if err != nil {
+			return err
+		}
+		if v.AltPaths == nil {
+			altPaths = []byte("[]")
+		}
+		sidecars, err := json.Marshal(v.Sidecars)
+		if err != nil {
+			return err
+		}
+		if v.Sidecars == nil {
+			sidecars = []byte("[]")
+		}
+		if _, err := stmt.Exec(v.ID, v.Path, v.Name, v.Fingerprint, string(altPaths), string(sidecars), v.Size, v.ModTime, int64(v.Inode), v.Duration, string(info)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM video_meta WHERE video_id = ? AND key GLOB ?", v.ID, subtitleOffsetMeta+"*"); err != nil {
+			return err
+		}
+		for key, offset := range v.SubtitleOffsets {
+			value := strconv.FormatFloat(offset, 'f', -1, 64)
+			if _, err := tx.Exec("INSERT INTO video_meta (video_id, key, value) VALUES (?, ?, ?)", v.ID, subtitleOffsetMeta+key, value); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM video_aliases WHERE video_id = ?", v.ID); err != nil {
+			return err
+		}
+		for _, alias := range v.Aliases {
+			if _, err := tx.Exec("INSERT OR REPLACE INTO video_aliases (alias, video_id) VALUES (?, ?)", alias, v.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) DeleteVideos(ids ...string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		if _, err := tx.Exec("DELETE FROM videos WHERE id = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM video_meta WHERE video_id = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM video_aliases WHERE video_id = ?", id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Collections() ([]Collection, error) {
+	rows, err := s.db.Query("SELECT id, name, created_at, updated_at FROM collections ORDER BY created_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cols []Collection
+	index := make(map[string]int)
+	for rows.Next() {
+		var col Collection
+		var created, updated int64
+		if err := rows.Scan(&col.ID, &col.Name, &created, &updated); err != nil {
+			return nil, err
+		}
+		col.CreatedAt, col.UpdatedAt = time.Unix(created, 0), time.Unix(updated, 0)
+		col.VideoIDs = []string{}
+		index[col.ID] = len(cols)
+		cols = append(cols, col)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	items, err := s.db.Query("SELECT collection_id, video_id FROM collection_items ORDER BY collection_id, position")
+	if err != nil {
+		return nil, err
+	}
+	defer items.Close()
+	for items.Next() {
+		var colID, videoID string
+		if err := items.Scan(&colID, &videoID); err != nil {
+			return nil, err
+		}
+		if i, ok := index[colID]; ok {
+			cols[i].VideoIDs = append(cols[i].VideoIDs, videoID)
+		}
+	}
+	return cols, items.Err()
+}
+
+func (s *sqliteStore) PutCollection(col Collection) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO collections (id, name, created_at, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET name = excluded.name, updated_at = excluded.updated_at`,
+		col.ID, col.Name, col.CreatedAt.Unix(), col.UpdatedAt.Unix()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM collection_items WHERE collection_id = ?", col.ID); err != nil {
+		return err
+	}
+	for i, id := range col.VideoIDs {
+		if _, err := tx.Exec("INSERT INTO collection_items (collection_id, position, video_id) VALUES (?, ?, ?)", col.ID, i, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) DeleteCollection(id string) error {
+	_, err := s.db.Exec("DELETE FROM collections WHERE id = ?", id)
+	return err
+}
+
+func (s *sqliteStore) Progress() ([]WatchProgress, error) {
+	rows, err := s.db.Query("SELECT user_id, video_id, position, duration, watched, updated_at FROM watch_progress")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []WatchProgress
+	for rows.Next() {
+		var p WatchProgress
+		var updated int64
+		if err := rows.Scan(&p.UserID, &p.VideoID, &p.Position, &p.Duration, &p.Watched, &updated); err != nil {
+			return nil, err
+		}
+		p.UpdatedAt = time.Unix(updated, 0)
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqliteStore) PutProgress(p WatchProgress) error {
+	_, err := s.db.Exec(`INSERT INTO watch_progress (user_id, video_id, position, duration, watched, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, video_id) DO UPDATE SET position = excluded.position, duration = excluded.duration,
+			watched = excluded.watched, updated_at = excluded.updated_at`,
+		p.UserID, p.VideoID, p.Position, p.Duration, p.Watched, p.UpdatedAt.Unix())
+	return err
+}
+
+func (s *sqliteStore) DeleteProgress(userID, videoID string) error {
+	_, err := s.db.Exec("DELETE FROM watch_progress WHERE user_id = ? AND video_id = ?", userID, videoID)
+	return err
+}
+
+func (s *sqliteStore) Users() ([]User, error) {
+	rows, err := s.db.Query("SELECT id, username, password_hash, admin, created_at FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []User
+	for rows.Next() {
+		var u User
+		var created int64
+		if err := rows.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Admin, &created); err != nil {
+			return nil, err
+		}
+		u.CreatedAt = time.Unix(created, 0)
+		list = append(list, u)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqliteStore) PutUser(u User) error {
+	_, err := s.db.Exec(`INSERT INTO users (id, username, password_hash, admin, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET username = excluded.username, password_hash = excluded.password_hash, admin = excluded.admin`,
+		u.ID, u.Username, u.PasswordHash, u.Admin, u.CreatedAt.Unix())
+	return err
+}
+
+// DeleteUser removes the account; sessions go with it (ON DELETE CASCADE),
+// watch progress is keyed by text and removed here.
+func (s *sqliteStore) DeleteUser(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM watch_progress WHERE user_id = ?", userKey(id)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Sessions() ([]Session, error) {
+	rows, err := s.db.Query("SELECT token, user_id, created_at, expires_at FROM sessions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Session
+	for rows.Next() {
+		var sess Session
+		var created, expires int64
+		if err := rows.Scan(&sess.TokenHash, &sess.UserID, &created, &expires); err != nil {
+			return nil, err
+		}
+		sess.CreatedAt, sess.ExpiresAt = time.Unix(created, 0), time.Unix(expires, 0)
+		list = append(list, sess)
+	}
+	return list, rows.Err()
+}
+
+// PutSession stores the token hash in the token column; expired sessions
+// are cleared on the way.
+func (s *sqliteStore) PutSession(sess Session) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM sessions WHERE expires_at <= ?", time.Now().Unix()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO sessions (token, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		sess.TokenHash, sess.UserID, sess.CreatedAt.Unix(), sess.ExpiresAt.Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) DeleteSessions(tokenHashes ...string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, h := range tokenHashes {
+		if _, err := tx.Exec("DELETE FROM sessions WHERE token = ?", h); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,321 @@
+package internal
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openTestSQLite opens a new database in a temporary directory.
+func openTestSQLite(t *testing.T) *sqliteStore {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := openSQLiteStore(filepath.Join(dir, "library.db"), filepath.Join(dir, "videos.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestVideoLookups(t *testing.T) {
+	a := VideoData{ID: "a", Path: "/video/a.mkv", Fingerprint: "fp1", Aliases: []string{"old"},
+		AltPaths: []string{"/video/copy of a.mkv"}, SubtitleOffsets: map[string]float64{"0": 1.5}}
+	b := VideoData{ID: "b", Path: "/video/b.mkv", Fingerprint: "fp1"}
+	c := VideoData{ID: "c", Path: "/video/c.mkv", Fingerprint: "fp2"}
+
+	dir := t.TempDir()
+	jsonLib, err := openJSONStore(filepath.Join(dir, "videos.json"), filepath.Join(dir, "collections.json"),
+		filepath.Join(dir, "progress.json"), filepath.Join(dir, "auth.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]LibraryStore{"sqlite": openTestSQLite(t), "json": jsonLib}
+
+	for name, store := range stores {
+		if err := store.PutVideos(a, b, c); err != nil {
+			t.Fatal(err)
+		}
+		lookups := []struct {
+			what  string
+			get   func() (VideoData, bool, error)
+			want  VideoData
+			found bool
+		}{
+			{"id", func() (VideoData, bool, error) { return store.Video("a") }, a, true},
+			{"alias", func() (VideoData, bool, error) { return store.Video("old") }, a, true},
+			{"unknown id", func() (VideoData, bool, error) { return store.Video("x") }, VideoData{}, false},
+			{"path", func() (VideoData, bool, error) { return store.VideoByPath("/video/c.mkv") }, c, true},
+			{"merged copy", func() (VideoData, bool, error) { return store.VideoByPath("/video/copy of a.mkv") }, VideoData{}, false},
+		}
+		for _, l := range lookups {
+			got, found, err := l.get()
+			if err != nil {
+				t.Fatalf("%s: %s: %v", name, l.what, err)
+			}
+			if found != l.found || !reflect.DeepEqual(got, l.want) {
+				t.Errorf("%s: by %s = %+v, %v; want %+v, %v", name, l.what, got, found, l.want, l.found)
+			}
+		}
+
+		dups, err := store.VideosByFingerprint("fp1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(dups, []VideoData{a, b}) {
+			t.Errorf("%s: by fingerprint = %+v, want a and b", name, dups)
+		}
+	}
+}
+
+func TestSQLiteMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "library.db")
+	for range 2 { // the second open finds nothing to do
+		s, err := openSQLiteStore(path, filepath.Join(t.TempDir(), "videos.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var version int
+		if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		if version != len(migrations) {
+			t.Errorf("user_version = %d, want %d", version, len(migrations))
+		}
+		s.Close()
+	}
+
+	s := openTestSQLite(t)
+	for _, name := range []string{"videos", "users", "sessions", "watch_progress", "video_meta", "video_aliases",
+		"collections", "collection_items", "videos_path", "videos_fingerprint"} {
+		var n int
+		if err := s.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = ?", name).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("schema has no %s", name)
+		}
+	}
+}
+
+func TestSQLiteImportJSON(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "videos.json")
+	videos := []VideoData{
+		{ID: "a", Path: "/video/a.mkv", Name: "A", Fingerprint: "fp-a", Size: 10, MediaInfo: MediaInfo{Duration: 60}},
+		{ID: "b", Path: "/video/b.mkv", Name: "B", Fingerprint: "fp-b", Size: 20},
+	}
+	if err := writeJSONFile(jsonPath, videos); err != nil {
+		t.Fatal(err)
+	}
+
+	dbPath := filepath.Join(dir, "library.db")
+	s, err := openSQLiteStore(dbPath, jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Videos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, videos) {
+		t.Errorf("imported %+v, want %+v", got, videos)
+	}
+	if fileExists(jsonPath) || !fileExists(jsonPath+".imported") {
+		t.Error("videos.json not renamed to videos.json.imported")
+	}
+	s.Close()
+
+	// A non-empty database never imports again
+	if err := writeJSONFile(jsonPath, []VideoData{{ID: "c", Path: "/video/c.mkv"}}); err != nil {
+		t.Fatal(err)
+	}
+	s, err = openSQLiteStore(dbPath, jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, _ := s.Videos(); len(got) != 2 {
+		t.Errorf("%d videos after reopening, want 2", len(got))
+	}
+	if !fileExists(jsonPath) {
+		t.Error("videos.json renamed without importing it")
+	}
+}
+
+func TestSQLiteVideos(t *testing.T) {
+	s := openTestSQLite(t)
+	full := VideoData{
+		ID: "a", Path: "/video/a.mkv", Name: "A", Fingerprint: "fp", Aliases: []string{"old1", "old2"},
+		AltPaths: []string{"/video/copy.mkv"}, Size: 1 << 40, ModTime: time.Now().UnixNano(), Inode: 1 << 63,
+		MediaInfo: MediaInfo{
+			ProbeVersion: mediaProbeVersion, Duration: 5400.5, StartTime: 1.4, Width: 1920, Height: 1080,
+			Container: "matroska,webm", Bitrate: 8e6, FrameRate: 23.976, VideoStream: 1, VideoCodec: "hevc",
+			AudioCodec: "aac", PixFmt: "yuv420p10le", HDR: true,
+			AudioTracks:    []AudioTrack{{Index: 0, Codec: "aac", Language: "ita", Channels: 6, Default: true}},
+			SubtitleTracks: []SubtitleTrack{{Index: 0, Codec: "subrip", Language: "eng", Forced: true}},
+			Chapters:       []Chapter{{Start: 0, End: 60, Title: "Intro"}},
+		},
+		Sidecars:        []SidecarSubtitle{{Path: "/video/a.it.srt", Format: "srt", Language: "it", Size: 100}},
+		SubtitleOffsets: map[string]float64{"0": -1.25, "ext0": 0.5},
+	}
+	bare := VideoData{ID: "b", Path: "/video/b.mkv"}
+	if err := s.PutVideos(full, bare); err != nil {
+		t.Fatal(err)
+	}
+	check := func(step string, want ...VideoData) {
+		t.Helper()
+		got, err := s.Videos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", step, got, want)
+		}
+	}
+	check("put", full, bare)
+
+	// Replacing drops the aliases and offsets it no longer has
+	full.Aliases = []string{"old2"}
+	full.SubtitleOffsets = map[string]float64{"0": 2}
+	full.AltPaths, full.Sidecars = nil, nil
+	full.Path = "/video/renamed.mkv"
+	if err := s.PutVideos(full); err != nil {
+		t.Fatal(err)
+	}
+	check("replace", bare, full)
+
+	if err := s.DeleteVideos("a", "unknown"); err != nil {
+		t.Fatal(err)
+	}
+	check("delete", bare)
+	for _, table := range []string{"video_meta", "video_aliases"} {
+		var n int
+		if err := s.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("%d rows left in %s", n, table)
+		}
+	}
+}
+
+func TestSQLiteCollections(t *testing.T) {
+	s := openTestSQLite(t)
+	created := time.Unix(1700000000, 0)
+	a := Collection{ID: "a", Name: "Films", VideoIDs: []string{"v1", "v2", "v3"}, CreatedAt: created, UpdatedAt: created}
+	b := Collection{ID: "b", Name: "Empty", VideoIDs: []string{}, CreatedAt: created.Add(time.Hour), UpdatedAt: created.Add(time.Hour)}
+	for _, col := range []Collection{a, b} {
+		if err := s.PutCollection(col); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(step string, want ...Collection) {
+		t.Helper()
+		got, err := s.Collections()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) || len(want) > 0 && !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", step, got, want)
+		}
+	}
+	check("put", a, b)
+
+	a.Name, a.VideoIDs, a.UpdatedAt = "Movies", []string{"v3", "v1"}, created.Add(2*time.Hour)
+	if err := s.PutCollection(a); err != nil {
+		t.Fatal(err)
+	}
+	check("reorder", a, b)
+
+	for _, id := range []string{"a", "b", "unknown"} {
+		if err := s.DeleteCollection(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("delete")
+	var items int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM collection_items").Scan(&items); err != nil {
+		t.Fatal(err)
+	}
+	if items != 0 {
+		t.Errorf("%d collection items left", items)
+	}
+}
+
+func TestSQLiteProgress(t *testing.T) {
+	s := openTestSQLite(t)
+	p := WatchProgress{UserID: "1", VideoID: "v", Position: 120.5, Duration: 3600, UpdatedAt: time.Unix(1700000000, 0)}
+	other := WatchProgress{UserID: "2", VideoID: "v", Position: 10, Duration: 3600, UpdatedAt: time.Unix(1700000000, 0)}
+	for _, wp := range []WatchProgress{p, other} {
+		if err := s.PutProgress(wp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Position, p.Watched, p.UpdatedAt = 3590, true, p.UpdatedAt.Add(time.Hour)
+	if err := s.PutProgress(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteProgress("2", "v"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Progress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []WatchProgress{p}) {
+		t.Errorf("progress = %+v, want %+v", got, p)
+	}
+}
+
+func TestSQLiteUsersAndSessions(t *testing.T) {
+	s := openTestSQLite(t)
+	created := time.Unix(1700000000, 0)
+	admin := User{ID: 1, Username: "admin", PasswordHash: "hash1", Admin: true, CreatedAt: created}
+	viewer := User{ID: 2, Username: "viewer", PasswordHash: "hash2", CreatedAt: created}
+	for _, u := range []User{admin, viewer} {
+		if err := s.PutUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	viewer.PasswordHash, viewer.Admin = "hash3", true
+	if err := s.PutUser(viewer); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Users(); err != nil || !reflect.DeepEqual(got, []User{admin, viewer}) {
+		t.Errorf("users = %+v, %v; want %+v", got, err, []User{admin, viewer})
+	}
+
+	future := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+	expired := Session{TokenHash: "expired", UserID: 1, CreatedAt: created, ExpiresAt: created.Add(time.Hour)}
+	live := Session{TokenHash: "live", UserID: 1, CreatedAt: created, ExpiresAt: future}
+	gone := Session{TokenHash: "gone", UserID: 1, CreatedAt: created, ExpiresAt: future}
+	viewers := Session{TokenHash: "viewer", UserID: 2, CreatedAt: created, ExpiresAt: future}
+	// Each put clears the sessions expired so far
+	for _, sess := range []Session{expired, live, gone, viewers} {
+		if err := s.PutSession(sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteSessions("gone", "unknown"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutProgress(WatchProgress{UserID: "2", VideoID: "v", UpdatedAt: created}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting a user takes its sessions and progress along
+	if err := s.DeleteUser(2); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Users(); err != nil || !reflect.DeepEqual(got, []User{admin}) {
+		t.Errorf("users after delete = %+v, %v", got, err)
+	}
+	if got, err := s.Sessions(); err != nil || !reflect.DeepEqual(got, []Session{live}) {
+		t.Errorf("sessions = %+v, %v; want only the live one", got, err)
+	}
+	if got, err := s.Progress(); err != nil || len(got) != 0 {
+		t.Errorf("progress of the deleted user = %+v, %v", got, err)
+	}
+}
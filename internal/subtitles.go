@@ -0,0 +1,435 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Text subtitle tracks, embedded or sidecar files, are converted once,
+// whole, to WebVTT and cut on the fly into segments matching the video ones.
+// Embedded tracks are named after the fingerprint like the other derived
+// artifacts, sidecars after their own file (see sidecarFile).
+const subtitlesDir = "/data/subtitles"
+
+// maxSubtitleOffset bounds the timing correction of a track, in seconds.
+const maxSubtitleOffset = 600
+
+// textSubtitleCodecs can be converted to WebVTT; bitmap subtitles (PGS,
+// DVD) would need OCR and are not offered.
+var textSubtitleCodecs = map[string]bool{
+	"subrip":   true,
+	"srt":      true,
+	"ass":      true,
+	"ssa":      true,
+	"mov_text": true,
+	"webvtt":   true,
+	"text":     true,
+}
+
+// vttCue is one cue of a WebVTT file, times in seconds from the start of the video.
+type vttCue struct {
+	Start    float64
+	End      float64
+	Settings string // cue settings after the timing, e.g. "align:start"
+	Text     string
+}
+
+// subtitleCues keeps the parsed tracks in memory, by file.
+var subtitleCues = struct {
+	mu    sync.Mutex
+	files map[string][]vttCue
+}{files: make(map[string][]vttCue)}
+
+// SubtitleRendition is a subtitle track offered to the player: a text
+// stream of the file or a sidecar.
+type SubtitleRendition struct {
+	ID       string  `json:"id"` // "2" for stream 0:s:2, "ext0" for the first sidecar
+	Name     string  `json:"name"`
+	Language string  `json:"language,omitempty"` // RFC 5646
+	Format   string  `json:"format"`
+	Default  bool    `json:"default"`
+	Forced   bool    `json:"forced"`
+	Sidecar  string  `json:"sidecar,omitempty"` // file path
+	Offset   float64 `json:"offset"`            // seconds added to every cue
+
+	stream  int              // 0:s:N, -1 for a sidecar
+	sidecar *SidecarSubtitle // nil for a stream
+	key     string           // SubtitleOffsets key: the stream number or the sidecar file name
+}
+
+// subtitleRenditions returns the subtitle tracks of a video that can be
+// served: embedded text streams first, then sidecars.
+func subtitleRenditions(video *VideoData) []SubtitleRendition {
+	var out []SubtitleRendition
+	names := make(map[string]bool)
+	defaultSet := false
+	add := func(r SubtitleRendition, title, lang string, index int) {
+		var langName string
+		r.Language, langName = hlsLanguage(lang)
+		r.Name = mediaName(names, title, langName, "Sottotitoli", index)
+		r.Offset = video.SubtitleOffsets[r.key]
+		// One default at most
+		r.Default = r.Default && !defaultSet
+		defaultSet = defaultSet || r.Default
+		out = append(out, r)
+	}
+
+	for _, t := range video.SubtitleTracks {
+		if !textSubtitleCodecs[t.Codec] {
+			continue
+		}
+		id := strconv.Itoa(t.Index)
+		add(SubtitleRendition{ID: id, Format: t.Codec, Default: t.Default, Forced: t.Forced, stream: t.Index, key: id},
+			t.Title, t.Language, len(out))
+	}
+	for i := range video.Sidecars {
+		sc := &video.Sidecars[i]
+		add(SubtitleRendition{ID: fmt.Sprintf("ext%d", i), Format: sc.Format, Forced: sc.Forced, Sidecar: sc.Path,
+			stream: -1, sidecar: sc, key: filepath.Base(sc.Path)},
+			sc.Title, sc.Language, len(out))
+	}
+	return out
+}
+
+// findSubtitle returns the subtitle rendition with the given ID, or nil.
+func findSubtitle(video *VideoData, id string) *SubtitleRendition {
+	for _, r := range subtitleRenditions(video) {
+		if r.ID == id {
+			return &r
+		}
+	}
+	return nil
+}
+
+func subtitleFile(fingerprint string, index int, ext string) string {
+	return filepath.Join(subtitlesDir, fingerprint, fmt.Sprintf("%d.%s", index, ext))
+}
+
+// removeSubtitles deletes the converted tracks of a content.
+func removeSubtitles(fingerprint string) {
+	if fingerprint == "" {
+		return
+	}
+	dir := filepath.Join(subtitlesDir, fingerprint)
+	subtitleCues.mu.Lock()
+	for file := range subtitleCues.files {
+		if strings.HasPrefix(file, dir+string(filepath.Separator)) {
+			delete(subtitleCues.files, file)
+		}
+	}
+	subtitleCues.mu.Unlock()
+	os.RemoveAll(dir)
+}
+
+// subtitleMedia writes the #EXT-X-MEDIA entries of the subtitle tracks, in
+// the "subs" group.
+func subtitleMedia(video *VideoData) string {
+	var b strings.Builder
+	for _, r := range subtitleRenditions(video) {
+		fmt.Fprintf(&b, `#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="%s"`, r.Name)
+		if r.Language != "" {
+			fmt.Fprintf(&b, `,LANGUAGE="%s"`, r.Language)
+		}
+		fmt.Fprintf(&b, ",DEFAULT=%s,AUTOSELECT=YES,FORCED=%s", yesNo(r.Default), yesNo(r.Forced))
+		fmt.Fprintf(&b, ",URI=\"subtitles/%s/playlist.m3u8\"\n", r.ID)
+	}
+	return b.String()
+}
+
+// loadSubtitleCues returns the cues of a track, converting it on first use.
+func loadSubtitleCues(ctx context.Context, video *VideoData, r *SubtitleRendition) ([]vttCue, error) {
+	var file string
+	var convert func(ctx context.Context) error
+	if r.sidecar != nil {
+		sc := *r.sidecar
+		file = sidecarFile(sc, "vtt")
+		convert = func(ctx context.Context) error { return convertSidecar(ctx, sc, file, "webvtt") }
+	} else {
+		file = subtitleFile(video.Fingerprint, r.stream, "vtt")
+		convert = func(ctx context.Context) error { return extractSubtitle(ctx, video, r.stream, file, "webvtt") }
+	}
+
+	subtitleCues.mu.Lock()
+	cues, ok := subtitleCues.files[file]
+	subtitleCues.mu.Unlock()
+	if ok {
+		return cues, nil
+	}
+
+	if !fileExists(file) {
+		// One conversion per track, whatever the segments requested meanwhile
+		key := JobKey{VideoID: video.ID, Rendition: "subs_" + r.ID}
+		err := transcoder.Run(ctx, key, PriorityPrefetch, func(ctx context.Context) error {
+			if fileExists(file) {
+				return nil
+			}
+			return convert(ctx)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cues = parseVTT(string(data))
+	subtitleCues.mu.Lock()
+	subtitleCues.files[file] = cues
+	subtitleCues.mu.Unlock()
+	return cues, nil
+}
+
+// extractSubtitle converts subtitle stream 0:s:index of the video to format,
+// "webvtt" or "ass". In WebVTT the ASS styling is lost, only the text and the
+// position hints survive.
+func extractSubtitle(ctx context.Context, video *VideoData, index int, out, format string) error {
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+	tmp := out + ".tmp"
+	defer os.Remove(tmp)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-v", "error",
+		"-i", video.Path,
+		"-map", fmt.Sprintf("0:s:%d", index),
+		"-c:s", format,
+		"-f", format,
+		"-y", tmp,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return os.Rename(tmp, out)
+}
+
+// parseVTT reads the cues of a WebVTT file; the header, NOTE and STYLE
+// blocks are skipped, as are cues with a malformed timing line.
+func parseVTT(data string) []vttCue {
+	data = strings.ReplaceAll(strings.TrimPrefix(data, "\ufeff"), "\r\n", "\n")
+	var cues []vttCue
+	for _, block := range strings.Split(data, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		// The timing line comes first, or second after a cue identifier
+		for i, line := range lines {
+			if i > 1 {
+				break
+			}
+			start, rest, ok := strings.Cut(line, "-->")
+			if !ok {
+				continue
+			}
+			fields := strings.Fields(rest)
+			if len(fields) == 0 {
+				break
+			}
+			s, err1 := parseVTTTimestamp(strings.TrimSpace(start))
+			e, err2 := parseVTTTimestamp(fields[0])
+			if err1 != nil || err2 != nil {
+				break
+			}
+			cues = append(cues, vttCue{
+				Start:    s,
+				End:      e,
+				Settings: strings.Join(fields[1:], " "),
+				Text:     strings.Join(lines[i+1:], "\n"),
+			})
+			break
+		}
+	}
+	return cues
+}
+
+// parseVTTTimestamp parses hh:mm:ss.mmm, hours being optional.
+func parseVTTTimestamp(s string) (float64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	sec, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, err
+	}
+	mult := 60.0
+	for i := len(parts) - 2; i >= 0; i-- {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return 0, err
+		}
+		sec += float64(n) * mult
+		mult *= 60
+	}
+	return sec, nil
+}
+
+// subtitleSegment writes the cues overlapping [start, end), shifted by
+// offset. Segments carry source timestamps (see -output_ts_offset), so cue
+// times are kept as they are and mapped to MPEG-TS time zero.
+func subtitleSegment(cues []vttCue, offset, start, end float64) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n\n")
+	for _, cue := range cues {
+		cueStart, cueEnd := cue.Start+offset, cue.End+offset
+		if cueEnd <= start || cueStart >= end || cueEnd <= 0 {
+			continue
+		}
+		b.WriteString(vttTimestamp(max(cueStart, 0)) + " --> " + vttTimestamp(cueEnd))
+		if cue.Settings != "" {
+			b.WriteString(" " + cue.Settings)
+		}
+		b.WriteString("\n" + cue.Text + "\n\n")
+	}
+	return b.String()
+}
+
+// SetSubtitleOffset records the timing correction of a subtitle track,
+// kept across rescans with the video.
+func SetSubtitleOffset(videoID, trackID string, offset float64) (SubtitleRendition, error) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	i, ok := videoIndex[videoID]
+	if !ok {
+		return SubtitleRendition{}, errVideoNotFound
+	}
+	v := videoCache[i]
+	var r *SubtitleRendition
+	for _, x := range subtitleRenditions(&v) {
+		if x.ID == trackID {
+			r = &x
+			break
+		}
+	}
+	if r == nil {
+		return SubtitleRendition{}, errSubtitleNotFound
+	}
+
+	offsets := make(map[string]float64, len(v.SubtitleOffsets)+1)
+	for k, o := range v.SubtitleOffsets {
+		offsets[k] = o
+	}
+	if offset == 0 {
+		delete(offsets, r.key)
+	} else {
+		offsets[r.key] = offset
+	}
+	if len(offsets) == 0 {
+		offsets = nil
+	}
+	v.SubtitleOffsets = offsets
+
+	result := make([]VideoData, len(videoCache))
+	copy(result, videoCache)
+	result[i] = v
+	saveChanges([]VideoData{v}, nil)
+	setVideoCacheLocked(result)
+
+	r.Offset = offset
+	return *r, nil
+}
+
+var (
+	errVideoNotFound    = errors.New("video not found")
+	errSubtitleNotFound = errors.New("subtitle track not found")
+)
+
+// GET /stream/:id/subtitles
+func HandleSubtitleList(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	list := subtitleRenditions(video)
+	if list == nil {
+		list = []SubtitleRendition{}
+	}
+	c.JSON(200, list)
+}
+
+// GET /stream/:id/subtitles/:track/playlist.m3u8
+func HandleSubtitlePlaylist(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	if findSubtitle(video, c.Param("track")) == nil {
+		c.String(404, "subtitle track not found")
+		return
+	}
+
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	c.String(200, indexPlaylist(GetKeyframeIndex(video), "%d.vtt"))
+}
+
+// GET /stream/:id/subtitles/:track/:n (e.g. 12.vtt)
+func HandleSubtitleSegment(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	track := findSubtitle(video, c.Param("track"))
+	if track == nil || (track.sidecar == nil && video.Fingerprint == "") {
+		c.String(404, "subtitle track not found")
+		return
+	}
+	idx := GetKeyframeIndex(video)
+	segNum, err := strconv.Atoi(strings.TrimSuffix(c.Param("n"), ".vtt"))
+	if err != nil || segNum < 0 || segNum >= idx.NumSegments() {
+		c.String(400, "invalid segment")
+		return
+	}
+
+	cues, err := loadSubtitleCues(c.Request.Context(), video, track)
+	if err != nil {
+		if c.Request.Context().Err() == nil {
+			fmt.Printf("[subtitles] track %s of %s: %v\n", track.ID, video.Path, err)
+			c.String(500, "subtitle error")
+		}
+		return
+	}
+
+	// Not cached: the offset can change at any time
+	start, duration := idx.Segment(segNum)
+	c.Header("Cache-Control", "no-cache")
+	c.Data(200, "text/vtt; charset=utf-8", []byte(subtitleSegment(cues, track.Offset, start, start+duration)))
+}
+
+// PUT /stream/:id/subtitles/:track/offset {"offset": -1.5}, admins only
+// Seconds added to every cue: positive delays the subtitles.
+func HandleSubtitleOffset(c *gin.Context) {
+	var req struct {
+		Offset *float64 `json:"offset"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Offset == nil {
+		c.String(400, "offset required")
+		return
+	}
+	if math.IsNaN(*req.Offset) || math.Abs(*req.Offset) > maxSubtitleOffset {
+		c.String(400, fmt.Sprintf("offset must be within ±%d seconds", maxSubtitleOffset))
+		return
+	}
+	r, err := SetSubtitleOffset(c.Param("id"), c.Param("track"), *req.Offset)
+	if err != nil {
+		c.String(404, err.Error())
+		return
+	}
+	c.JSON(200, r)
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVTTTimestamp(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{"00:00:01.500", 1.5, false},
+		{"01:02:03.250", 3723.25, false},
+		{"02:03.250", 123.25, false},
+		{"00:00:00.000", 0, false},
+		{"1.5", 0, true},
+		{"1:2:3:4.000", 0, true},
+		{"aa:00:01.000", 0, true},
+		{"00:00:xx", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseVTTTimestamp(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseVTTTimestamp(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseVTTTimestamp(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseVTT(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []vttCue
+	}{
+		{
+			name: "header and plain cue",
+			in:   "WEBVTT\n\n00:00:01.000 --> 00:00:02.500\nHello\n",
+			want: []vttCue{{Start: 1, End: 2.5, Text: "Hello"}},
+		},
+		{
+			name: "BOM, CRLF and cue identifier",
+			in:   "\ufeffWEBVTT\r\n\r\n1\r\n00:01.000 --> 00:02.000\r\nOne\r\nTwo\r\n",
+			want: []vttCue{{Start: 1, End: 2, Text: "One\nTwo"}},
+		},
+		{
+			name: "cue settings",
+			in:   "WEBVTT\n\n00:00:01.000 --> 00:00:02.000 align:start line:0\nHi\n",
+			want: []vttCue{{Start: 1, End: 2, Settings: "align:start line:0", Text: "Hi"}},
+		},
+		{
+			name: "NOTE and STYLE blocks skipped",
+			in:   "WEBVTT\n\nNOTE a comment\n\nSTYLE\n::cue { color: red }\n\n00:00:03.000 --> 00:00:04.000\nText\n",
+			want: []vttCue{{Start: 3, End: 4, Text: "Text"}},
+		},
+		{
+			name: "malformed timing skipped",
+			in:   "WEBVTT\n\n00:00:xx --> 00:00:02.000\nBad\n\n00:00:05.000 -->\nEmpty\n\n00:00:06.000 --> 00:00:07.000\nGood\n",
+			want: []vttCue{{Start: 6, End: 7, Text: "Good"}},
+		},
+		{
+			name: "no cues",
+			in:   "WEBVTT\n",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseVTT(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseVTT() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubtitleSegment(t *testing.T) {
+	cues := []vttCue{
+		{Start: 1, End: 3, Text: "first"},
+		{Start: 5, End: 7, Settings: "align:start", Text: "second"},
+		{Start: 12, End: 14, Text: "third"},
+	}
+	tests := []struct {
+		name              string
+		offset            float64
+		start, end        float64
+		contains, missing []string
+	}{
+		{"overlapping cues only", 0, 0, 6, []string{"first", "second", "align:start"}, []string{"third"}},
+		{"cue ending at start is out", 0, 3, 10, []string{"second"}, []string{"first", "third"}},
+		{"offset delays cues", 5, 10, 20, []string{"second", "00:00:10.000 --> 00:00:12.000"}, []string{"first"}},
+		{"negative offset clamps at zero", -2, 0, 4, []string{"00:00:00.000 --> 00:00:01.000"}, []string{"third"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := subtitleSegment(cues, tt.offset, tt.start, tt.end)
+			if !strings.HasPrefix(got, "WEBVTT\nX-TIMESTAMP-MAP=") {
+				t.Fatalf("missing header: %q", got)
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(got, s) {
+					t.Errorf("segment lacks %q:\n%s", s, got)
+				}
+			}
+			for _, s := range tt.missing {
+				if strings.Contains(got, s) {
+					t.Errorf("segment has %q:\n%s", s, got)
+				}
+			}
+		})
+	}
+}
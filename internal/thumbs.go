@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Thumbnails are named after the video fingerprint, so a replaced file gets
+// a new one and a renamed file keeps its own.
+const thumbsDir = "/data/thumbs"
+
+// thumbWidths are the sizes served by /thumb, a requested width is rounded
+// up to the next one so the resized copies on disk stay few.
+var thumbWidths = []int{160, 320, 480, 640, 960, 1280}
+
+// Where to look for a poster frame, as a fraction of the duration: past the
+// intro, before the credits.
+var posterPositions = []float64{0.2, 0.35, 0.5, 0.1}
+
+// A failed extraction is retried after thumbRetryMin, doubling up to
+// thumbRetryMax: the failure may be load or I/O, not the file.
+const (
+	thumbRetryMin = time.Minute
+	thumbRetryMax = 24 * time.Hour
+)
+
+var thumbQueue = struct {
+	mu      sync.Mutex
+	pending []string                // video IDs
+	failed  map[string]thumbFailure // by fingerprint
+	wake    chan struct{}
+}{
+	failed: make(map[string]thumbFailure),
+	wake:   make(chan struct{}, 1),
+}
+
+// thumbFailure is a fingerprint whose poster could not be extracted.
+type thumbFailure struct {
+	count int
+	retry time.Time // no attempt before
+}
+
+// thumbRetryDelay is the wait after the given number of failures in a row.
+func thumbRetryDelay(failures int) time.Duration {
+	delay := thumbRetryMin
+	for i := 1; i < failures && delay < thumbRetryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, thumbRetryMax)
+}
+
+// thumbBackingOffLocked reports whether a fingerprint failed too recently
+// to try again. thumbQueue.mu must be held.
+func thumbBackingOffLocked(fingerprint string) bool {
+	f, ok := thumbQueue.failed[fingerprint]
+	return ok && time.Now().Before(f.retry)
+}
+
+func thumbnailFile(fingerprint string, width int) string {
+	if width == 0 {
+		return filepath.Join(thumbsDir, fingerprint+".jpg")
+	}
+	return filepath.Join(thumbsDir, fmt.Sprintf("%s_w%d.jpg", fingerprint, width))
+}
+
+// thumbWidth rounds a requested width to a served one, 0 is the full poster.
+func thumbWidth(requested int) int {
+	if requested <= 0 {
+		return 0
+	}
+	for _, w := range thumbWidths {
+		if requested <= w {
+			return w
+		}
+	}
+	return thumbWidths[len(thumbWidths)-1]
+}
+
+// StartThumbnails extracts in the background the posters still missing.
+func StartThumbnails() {
+	go thumbnailLoop()
+	QueueThumbnails(GetVideos()...)
+}
+
+// QueueThumbnails adds videos to the background poster extraction.
+func QueueThumbnails(videos ...VideoData) {
+	thumbQueue.mu.Lock()
+	n := 0
+	for _, v := range videos {
+		if v.Fingerprint != "" && !fileExists(thumbnailFile(v.Fingerprint, 0)) && !thumbBackingOffLocked(v.Fingerprint) {
+			thumbQueue.pending = append(thumbQueue.pending, v.ID)
+			n++
+		}
+	}
+	thumbQueue.mu.Unlock()
+
+	if n > 0 {
+		fmt.Printf("[thumbs] %d posters to extract\n", n)
+		select {
+		case thumbQueue.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// thumbnailLoop extracts one poster at a time, behind any playback work.
+func thumbnailLoop() {
+	for {
+		thumbQueue.mu.Lock()
+		if len(thumbQueue.pending) == 0 {
+			thumbQueue.mu.Unlock()
+			<-thumbQueue.wake
+			continue
+		}
+		id := thumbQueue.pending[0]
+		thumbQueue.pending = thumbQueue.pending[1:]
+		thumbQueue.mu.Unlock()
+
+		if video := GetVideoByID(id); video != nil {
+			ensurePoster(context.Background(), video, PriorityBackground)
+		}
+	}
+}
+
+// ensurePoster extracts the poster of a video unless it is on disk already.
+func ensurePoster(ctx context.Context, video *VideoData, priority JobPriority) error {
+	if video.Fingerprint == "" {
+		return fmt.Errorf("no fingerprint yet")
+	}
+	poster := thumbnailFile(video.Fingerprint, 0)
+	if fileExists(poster) {
+		return nil
+	}
+	thumbQueue.mu.Lock()
+	backingOff := thumbBackingOffLocked(video.Fingerprint)
+	thumbQueue.mu.Unlock()
+	if backingOff {
+		return fmt.Errorf("extraction failed recently, retrying later")
+	}
+
+	key := JobKey{VideoID: video.ID, Rendition: "thumb"}
+	return transcoder.Run(ctx, key, priority, func(ctx context.Context) error {
+		if fileExists(poster) {
+			return nil
+		}
+		err := extractPoster(ctx, video, poster)
+		if ctx.Err() != nil {
+			return err
+		}
+		thumbQueue.mu.Lock()
+		defer thumbQueue.mu.Unlock()
+		if err == nil {
+			delete(thumbQueue.failed, video.Fingerprint)
+			return nil
+		}
+		f := thumbQueue.failed[video.Fingerprint]
+		f.count++
+		delay := thumbRetryDelay(f.count)
+		f.retry = time.Now().Add(delay)
+		thumbQueue.failed[video.Fingerprint] = f
+		fmt.Printf("[thumbs] failed %s (retry in %v): %v\n", video.Path, delay, err)
+
+		id := video.ID
+		time.AfterFunc(delay, func() {
+			if v := GetVideoByID(id); v != nil {
+				QueueThumbnails(*v)
+			}
+		})
+		return err
+	})
+}
+
+// extractPoster writes a representative frame of the video: frames mostly
+// black are dropped, then the thumbnail filter picks the most typical of a
+// batch. Tries a few positions until one gives a frame.
+func extractPoster(ctx context.Context, video *VideoData, poster string) error {
+	if err := os.MkdirAll(thumbsDir, 0755); err != nil {
+		return err
+	}
+	tmp := poster + ".tmp.jpg"
+	defer os.Remove(tmp)
+
+	filter := "blackframe=amount=0:threshold=32," +
+		"metadata=mode=select:key=lavfi.blackframe.pblack:value=85:function=less," +
+		"thumbnail=60,scale='min(1280,iw)':-2"
+
+	var lastErr error
+	for _, pos := range posterPositions {
+		start := 0.0
+		if video.Duration > 0 {
+			start = video.Duration * pos
+		}
+		cmd := exec.CommandContext(ctx, "ffmpeg",
+			"-v", "error",
+			"-ss", formatSeconds(start),
+			"-t", "20",
+			"-i", video.Path,
+			"-map", videoStreamMap(video.VideoStream),
+			"-an", "-sn",
+			"-vf", filter,
+			"-frames:v", "1",
+			"-q:v", "3",
+			"-y", tmp,
+		)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if info, statErr := os.Stat(tmp); err == nil && statErr == nil && info.Size() > 0 {
+			return os.Rename(tmp, poster)
+		}
+		lastErr = fmt.Errorf("no frame at %.0fs: %v %s", start, err, strings.TrimSpace(stderr.String()))
+		if video.Duration <= 0 {
+			break
+		}
+	}
+	return lastErr
+}
+
+// resizeThumbnail writes a copy of the poster scaled to width.
+func resizeThumbnail(poster, out string, width int) error {
+	tmp := out + ".tmp.jpg"
+	defer os.Remove(tmp)
+	cmd := exec.Command("ffmpeg",
+		"-v", "error",
+		"-i", poster,
+		"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", width),
+		"-q:v", "4",
+		"-y", tmp,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.Rename(tmp, out)
+}
+
+// removeThumbnails deletes the poster of a content and its resized copies.
+func removeThumbnails(fingerprint string) {
+	if fingerprint == "" {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(thumbsDir, fingerprint+"*.jpg"))
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+// GET /thumb/:id?w=320
+func HandleThumb(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	if video.Fingerprint == "" {
+		c.String(404, "thumbnail not available yet")
+		return
+	}
+	requested, _ := strconv.Atoi(c.Query("w"))
+	width := thumbWidth(requested)
+
+	// Cache headers go with a poster only, never with an error
+	etag := fmt.Sprintf(`"%s-%d"`, video.Fingerprint, width)
+	cacheable := func() {
+		c.Header("ETag", etag)
+		c.Header("Cache-Control", "public, max-age=3600")
+	}
+	if c.GetHeader("If-None-Match") == etag && fileExists(thumbnailFile(video.Fingerprint, 0)) {
+		cacheable()
+		c.Status(304)
+		return
+	}
+
+	if err := ensurePoster(c.Request.Context(), video, PriorityPrefetch); err != nil {
+		c.String(404, "thumbnail not available")
+		return
+	}
+	file := thumbnailFile(video.Fingerprint, width)
+	if width > 0 && !fileExists(file) {
+		lock := getSegmentLock("thumb_" + file)
+		lock.Lock()
+		var err error
+		if !fileExists(file) {
+			err = resizeThumbnail(thumbnailFile(video.Fingerprint, 0), file, width)
+		}
+		lock.Unlock()
+		if err != nil {
+			fmt.Printf("[thumbs] resize %s: %v\n", file, err)
+			c.String(500, "thumbnail error")
+			return
+		}
+	}
+	cacheable()
+	c.File(file)
+}
@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThumbWidth(t *testing.T) {
+	tests := []struct{ requested, want int }{
+		{0, 0},
+		{-10, 0},
+		{1, 160},
+		{160, 160},
+		{161, 320},
+		{500, 640},
+		{1280, 1280},
+		{4000, 1280},
+	}
+	for _, tt := range tests {
+		if got := thumbWidth(tt.requested); got != tt.want {
+			t.Errorf("thumbWidth(%d) = %d, want %d", tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestThumbRetryDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{11, 1024 * time.Minute},
+		{12, thumbRetryMax},
+		{1000, thumbRetryMax},
+	}
+	for _, tt := range tests {
+		if got := thumbRetryDelay(tt.failures); got != tt.want {
+			t.Errorf("thumbRetryDelay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
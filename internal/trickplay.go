@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Trickplay sheets are grids of small frames, one every trickplayInterval
+// seconds; the WebVTT index maps each time range to a region of a sheet.
+const (
+	trickplayDir      = "/data/trickplay"
+	trickplayInterval = 10  // seconds between frames
+	trickplayWidth    = 160 // frame width in pixels
+	trickplayColumns  = 10
+	trickplayRows     = 10
+)
+
+// trickplayFrameSize returns the size of one frame, keeping the aspect ratio.
+func trickplayFrameSize(video *VideoData) (int, int) {
+	if video.Width <= 0 || video.Height <= 0 {
+		return trickplayWidth, even(trickplayWidth * 9 / 16)
+	}
+	return trickplayWidth, even(trickplayWidth * video.Height / video.Width)
+}
+
+func trickplayFrames(video *VideoData) int {
+	return int(math.Ceil(video.Duration / trickplayInterval))
+}
+
+func trickplaySheets(video *VideoData) int {
+	per := trickplayColumns * trickplayRows
+	return (trickplayFrames(video) + per - 1) / per
+}
+
+// trickplaySheetFile is named after the fingerprint and the layout, so a
+// replaced file or a different layout never reuses old sheets.
+func trickplaySheetFile(video *VideoData, sheet int) string {
+	layout := fmt.Sprintf("%s-%d-%d", video.Fingerprint, trickplayInterval, trickplayWidth)
+	return filepath.Join(trickplayDir, layout, fmt.Sprintf("%d.jpg", sheet))
+}
+
+// removeTrickplay deletes every sheet made from a content.
+func removeTrickplay(fingerprint string) {
+	if fingerprint == "" {
+		return
+	}
+	dirs, _ := filepath.Glob(filepath.Join(trickplayDir, fingerprint+"-*"))
+	for _, d := range dirs {
+		os.RemoveAll(d)
+	}
+}
+
+// trickplayVTT builds the index; it only depends on duration and layout, so
+// it is served right away and sheets are made when the player asks for them.
+func trickplayVTT(video *VideoData) string {
+	w, h := trickplayFrameSize(video)
+	per := trickplayColumns * trickplayRows
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for i := 0; i < trickplayFrames(video); i++ {
+		start := float64(i * trickplayInterval)
+		end := math.Min(start+trickplayInterval, video.Duration)
+		cell := i % per
+		x, y := (cell%trickplayColumns)*w, (cell/trickplayColumns)*h
+		fmt.Fprintf(&b, "%s --> %s\ntrickplay/%d.jpg#xywh=%d,%d,%d,%d\n\n",
+			vttTimestamp(start), vttTimestamp(end), i/per, x, y, w, h)
+	}
+	return b.String()
+}
+
+// vttTimestamp formats seconds as hh:mm:ss.mmm.
+func vttTimestamp(sec float64) string {
+	ms := int64(math.Round(sec * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// generateTrickplaySheet renders one sheet: the frames of its time range,
+// scaled and tiled into a single JPEG.
+func generateTrickplaySheet(ctx context.Context, video *VideoData, sheet int, out string) error {
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+	w, h := trickplayFrameSize(video)
+	span := float64(trickplayInterval * trickplayColumns * trickplayRows)
+	tmp := out + ".tmp.jpg"
+	defer os.Remove(tmp)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-v", "error",
+		"-ss", formatSeconds(float64(sheet)*span),
+		"-t", formatSeconds(span),
+		"-i", video.Path,
+		"-map", videoStreamMap(video.VideoStream),
+		"-an", "-sn",
+		"-vf", fmt.Sprintf("fps=1/%d,scale=%d:%d,tile=%dx%d", trickplayInterval, w, h, trickplayColumns, trickplayRows),
+		"-frames:v", "1",
+		"-q:v", "5",
+		"-y", tmp,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return os.Rename(tmp, out)
+}
+
+// GET /stream/:id/trickplay.vtt
+func HandleTrickplayVTT(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	if video.Duration <= 0 || video.Fingerprint == "" {
+		c.String(404, "trickplay not available")
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Data(200, "text/vtt; charset=utf-8", []byte(trickplayVTT(video)))
+}
+
+// GET /stream/:id/trickplay/:sheet (e.g. 0.jpg)
+func HandleTrickplaySheet(c *gin.Context) {
+	video := GetVideoByID(c.Param("id"))
+	if video == nil {
+		c.String(404, "video not found")
+		return
+	}
+	sheet, err := strconv.Atoi(strings.TrimSuffix(c.Param("sheet"), ".jpg"))
+	if err != nil || sheet < 0 || sheet >= trickplaySheets(video) || video.Fingerprint == "" {
+		c.String(404, "sheet not found")
+		return
+	}
+
+	etag := fmt.Sprintf(`"%s-%d"`, video.Fingerprint, sheet)
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "public, max-age=3600")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(304)
+		return
+	}
+
+	// Same queue as segments, below them: never slows playback down
+	path := trickplaySheetFile(video, sheet)
+	if !fileExists(path) {
+		key := JobKey{VideoID: video.ID, Rendition: "trickplay", Segment: sheet}
+		err := transcoder.Run(c.Request.Context(), key, PriorityBackground, func(ctx context.Context) error {
+			if fileExists(path) {
+				return nil
+			}
+			return generateTrickplaySheet(ctx, video, sheet, path)
+		})
+		if err != nil {
+			if c.Request.Context().Err() == nil {
+				fmt.Printf("[trickplay] sheet %d of %s: %v\n", sheet, video.Path, err)
+				c.String(500, "trickplay error")
+			}
+			return
+		}
+	}
+	c.File(path)
+}
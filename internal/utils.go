@@ -4,7 +4,6 @@ import (
 	"encoding/hex"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -24,60 +23,16 @@ func isVideo(name string) bool {
 	return false
 }
 
-func videoDuration(path string) (float64, error) {
-	out, err := exec.Command("ffprobe",
-		"-v", "error",
-		"-show_entries", "format=duration",
-		"-of", "default=noprint_wrappers=1:nokey=1",
-		path,
-	).Output()
-	if err != nil {
-		return 0, err
-	}
-	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
-}
-
-func videoResolution(path string) (int, int, error) {
-	out, err := exec.Command("ffprobe",
-		"-v", "error",
-		"-select_streams", "v:0",
-		"-show_entries", "stream=width,height",
-		"-of", "csv=p=0",
-		path,
-	).Output()
-	if err != nil {
-		return 0, 0, err
-	}
-
-	// Trim spaces and trailing commas (some files output "1920,1080," instead of "1920,1080")
-	output := strings.TrimSpace(string(out))
-	output = strings.TrimSuffix(output, ",")
-
-	parts := strings.Split(output, ",")
-	if len(parts) != 2 {
-		return 0, 0, nil
-	}
-	w, _ := strconv.Atoi(parts[0])
-	h, _ := strconv.Atoi(parts[1])
-	return w, h, nil
-}
+var subtitleExts = []string{".srt", ".ass", ".ssa", ".vtt"}
 
-func videoTitle(path string) string {
-	// Try to get title from metadata
-	out, err := exec.Command("ffprobe",
-		"-v", "error",
-		"-show_entries", "format_tags=title",
-		"-of", "default=noprint_wrappers=1:nokey=1",
-		path,
-	).Output()
-	if err == nil {
-		title := strings.TrimSpace(string(out))
-		if title != "" {
-			return title
+func isSubtitle(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, s := range subtitleExts {
+		if ext == s {
+			return true
 		}
 	}
-	// Fallback to filename without extension
-	return nameWithoutExt(path)
+	return false
 }
 
 func fileHash(path string, megaBytes int64) (string, error) {
@@ -153,3 +108,19 @@ func nameWithoutExt(path string) string {
 	ext := filepath.Ext(base)
 	return strings.TrimSuffix(base, ext)
 }
+
+// envFloat reads a float from the environment, falling back to def.
+func envFloat(name string, def float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil {
+		return v
+	}
+	return def
+}
+
+// envInt reads an integer from the environment, falling back to def.
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	watchDebounce  = 2 * time.Second // quiet time after the last event on a path
+	watchSettle    = 3 * time.Second // interval between size checks of a growing file
+	watchMaxChecks = 600             // give up on files still growing after ~30 min
+)
+
+// libraryWatcher follows videoDir with inotify and updates the library
+// one file at a time, without a full rescan.
+type libraryWatcher struct {
+	fs       *fsnotify.Watcher
+	mu       sync.Mutex
+	timers   map[string]*time.Timer
+	settling map[string]bool
+}
+
+// StartWatcher watches videoDir and every folder below it.
+func StartWatcher() error {
+	fs, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	w := &libraryWatcher{
+		fs:       fs,
+		timers:   make(map[string]*time.Timer),
+		settling: make(map[string]bool),
+	}
+	dirs := w.addTree(videoDir)
+	go w.loop()
+	fmt.Printf("[watcher] started: watching %d folders under %s\n", dirs, videoDir)
+	return nil
+}
+
+// addTree adds a watch on root and its subfolders, returns how many.
+func (w *libraryWatcher) addTree(root string) int {
+	n := 0
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if err := w.fs.Add(path); err != nil {
+			fmt.Printf("[watcher] cannot watch %s: %v\n", path, err)
+			return nil
+		}
+		n++
+		return nil
+	})
+	return n
+}
+
+func (w *libraryWatcher) loop() {
+	for {
+		select {
+		case ev, ok := <-w.fs.Events:
+			if !ok {
+				return
+			}
+			w.handle(ev)
+		case err, ok := <-w.fs.Errors:
+			if !ok {
+				return
+			}
+			fmt.Printf("[watcher] error: %v\n", err)
+		}
+	}
+}
+
+func (w *libraryWatcher) handle(ev fsnotify.Event) {
+	// A new folder: watch it, and pick up files already moved inside
+	if ev.Has(fsnotify.Create) {
+		if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+			w.addTree(ev.Name)
+			filepath.Walk(ev.Name, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() && (isVideo(info.Name()) || isSubtitle(info.Name())) {
+					w.debounce(path)
+				}
+				return nil
+			})
+			return
+		}
+	}
+
+	// Removed or renamed away: may be a folder, so no extension check
+	if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+		w.debounce(ev.Name)
+		return
+	}
+	if isVideo(ev.Name) || isSubtitle(ev.Name) {
+		w.debounce(ev.Name)
+	}
+}
+
+// debounce (re)starts the quiet timer of a path: a copy generates a burst
+// of write events, we only act once it stops.
+func (w *libraryWatcher) debounce(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if t, ok := w.timers[path]; ok {
+		t.Reset(watchDebounce)
+		return
+	}
+	w.timers[path] = time.AfterFunc(watchDebounce, func() {
+		w.mu.Lock()
+		delete(w.timers, path)
+		w.mu.Unlock()
+		w.process(path)
+	})
+}
+
+func (w *libraryWatcher) process(path string) {
+	// A subtitle file added, changed or removed: only its folder is affected
+	if isSubtitle(path) {
+		for _, v := range RefreshSidecars(filepath.Dir(path)) {
+			fmt.Printf("[watcher] subtitles updated: %s\n", v.Path)
+			publishLibraryEvent(LibraryEvent{Type: "updated", ID: v.ID, Path: v.Path, Name: v.Name})
+		}
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		for _, v := range RemoveVideoPath(path) {
+			fmt.Printf("[watcher] removed: %s\n", v.Path)
+			publishLibraryEvent(LibraryEvent{Type: "removed", ID: v.ID, Path: v.Path, Name: v.Name})
+		}
+		return
+	}
+	if info.IsDir() || !isVideo(info.Name()) {
+		return
+	}
+
+	// Only one size check loop per file
+	w.mu.Lock()
+	if w.settling[path] {
+		w.mu.Unlock()
+		return
+	}
+	w.settling[path] = true
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(w.settling, path)
+		w.mu.Unlock()
+	}()
+
+	if !waitStable(path) {
+		fmt.Printf("[watcher] %s is still changing, skipped\n", path)
+		return
+	}
+
+	v, added, err := UpsertVideoFile(path)
+	if err != nil {
+		fmt.Printf("[watcher] error scanning %s: %v\n", path, err)
+		return
+	}
+	evType := "updated"
+	if added {
+		evType = "added"
+	}
+	fmt.Printf("[watcher] %s: %s\n", evType, v.Path)
+	QueueThumbnails(v)
+	publishLibraryEvent(LibraryEvent{Type: evType, ID: v.ID, Path: v.Path, Name: v.Name})
+}
+
+// waitStable waits until the file stops growing: same size and mtime on two
+// checks watchSettle apart. Copies over SMB or scp don't always send events.
+func waitStable(path string) bool {
+	prev, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	for i := 0; i < watchMaxChecks; i++ {
+		time.Sleep(watchSettle)
+		cur, err := os.Stat(path)
+		if err != nil {
+			return false
+		}
+		if cur.Size() == prev.Size() && cur.ModTime().Equal(prev.ModTime()) && cur.Size() > 0 {
+			return true
+		}
+		prev = cur
+	}
+	return false
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"gazeparty/internal"
-	"time"
+	"os"
 
 	"github.com/gin-gonic/gin"
 )
@@ -15,19 +16,110 @@ func main() {
 		panic(err)
 	}
 
-	// Start background cleanup: check every 1min, remove files older than 8min
-	internal.StartCleanup(1*time.Minute, 8*time.Minute)
+	// Start the transcode queue (GAZEPARTY_WORKERS concurrent ffmpeg)
+	internal.StartScheduler()
+	internal.StartThumbnails()
 
-	r.GET("/", func(c *gin.Context) {
+	// Index cached segments and keep them within GAZEPARTY_CACHE_MB (LRU)
+	internal.StartCache()
+
+	// CLI: gazeparty optimize <id>... pre-transcodes now and exits
+	if len(os.Args) > 1 && os.Args[1] == "optimize" {
+		if err := internal.OptimizeNow(os.Args[2:]); err != nil {
+			fmt.Printf("[optimize] %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Follow /video for new, changed and removed files
+	if err := internal.StartWatcher(); err != nil {
+		fmt.Printf("[watcher] disabled: %v\n", err)
+	}
+
+	// Resume pre-transcodes, run new ones in GAZEPARTY_OPTIMIZE_WINDOW
+	internal.StartOptimizer()
+
+	// Login and first-run setup are the only open routes, with the static files
+	r.GET("/login", func(c *gin.Context) {
+		c.File("./static/login.html")
+	})
+	r.Static("/static", "./static")
+	r.POST("/auth/login", internal.HandleLogin)
+	r.POST("/auth/logout", internal.HandleLogout)
+	r.GET("/auth/setup", internal.HandleSetupStatus)
+	r.POST("/auth/setup", internal.HandleSetup)
+
+	// Pages send visitors to /login, the API answers 401
+	r.GET("/", internal.RequirePage, func(c *gin.Context) {
 		c.File("./static/index.html")
 	})
-	r.GET("/player", func(c *gin.Context) {
+	r.GET("/player", internal.RequirePage, func(c *gin.Context) {
 		c.File("./static/player.html")
 	})
-	r.Static("/static", "./static")
-	r.GET("/files", internal.HandleFiles)
-	r.GET("/stream/:id/playlist.m3u8", internal.HandlePlaylist)
-	r.GET("/stream/:id/:n", internal.HandleSegment)
+
+	api := r.Group("", internal.RequireUser)
+	api.GET("/auth/me", internal.HandleMe)
+	api.GET("/files", internal.HandleFiles)
+	api.GET("/events", internal.HandleEvents)
+	api.GET("/thumb/:id", internal.HandleThumb)
+	api.GET("/stream/:id/playlist.m3u8", internal.HandlePlaylist)
+	api.GET("/stream/:id/master.m3u8", internal.HandleMaster)
+	api.GET("/stream/:id/trickplay.vtt", internal.HandleTrickplayVTT)
+	api.GET("/stream/:id/trickplay/:sheet", internal.HandleTrickplaySheet)
+	api.GET("/stream/:id/audio/:track/playlist.m3u8", internal.HandleAudioPlaylist)
+	api.GET("/stream/:id/audio/:track/:n", internal.HandleAudioSegment)
+	api.GET("/stream/:id/subtitles", internal.HandleSubtitleList)
+	api.GET("/stream/:id/subtitles/:track/playlist.m3u8", internal.HandleSubtitlePlaylist)
+	api.PUT("/stream/:id/subtitles/:track/offset", internal.RequireAdmin, internal.HandleSubtitleOffset)
+	api.GET("/stream/:id/subtitles/:track/:n", internal.HandleSubtitleSegment)
+	api.GET("/stream/:id/:n", internal.HandleSegment)
+	api.GET("/stream/:id/rendition/:rendition/playlist.m3u8", internal.HandleRenditionPlaylist)
+	api.GET("/stream/:id/rendition/:rendition/:n", internal.HandleRenditionSegment)
+
+	// Library browsing
+	api.GET("/browse", internal.HandleBrowse)
+	api.GET("/collections", internal.HandleListCollections)
+	api.POST("/collections", internal.HandleCreateCollection)
+	api.GET("/collections/:cid", internal.HandleGetCollection)
+	api.PATCH("/collections/:cid", internal.HandleUpdateCollection)
+	api.DELETE("/collections/:cid", internal.HandleDeleteCollection)
+	api.POST("/collections/:cid/videos", internal.HandleAddToCollection)
+	api.DELETE("/collections/:cid/videos/:id", internal.HandleRemoveFromCollection)
+
+	// Watch progress, per user
+	api.GET("/progress", internal.HandleListProgress)
+	api.GET("/progress/:id", internal.HandleGetProgress)
+	api.PUT("/progress/:id", internal.HandlePutProgress)
+	api.DELETE("/progress/:id", internal.HandleDeleteProgress)
+
+	// TV series
+	api.GET("/series", internal.HandleSeriesList)
+	api.GET("/series/:id", internal.HandleSeries)
+	api.GET("/series/:id/seasons/:n", internal.HandleSeason)
+	api.GET("/episodes/:id/next", internal.HandleNextEpisode)
+
+	// Admin
+	admin := api.Group("/admin", internal.RequireAdmin)
+	admin.GET("/queue", internal.HandleQueueStats)
+	admin.GET("/cache", internal.HandleCacheStats)
+	admin.GET("/optimize", internal.HandleOptimizeList)
+	admin.POST("/optimize/:id", internal.HandleOptimizeQueue)
+	admin.DELETE("/optimize/:id", internal.HandleOptimizeRemove)
+	admin.GET("/rescan", internal.HandleRescanProgress)
+	admin.POST("/rescan", internal.HandleRescan)
+	admin.GET("/duplicates", internal.HandleDuplicates)
+	admin.POST("/videos/merge", internal.HandleMergeVideos)
+	admin.POST("/videos/:id/split", internal.HandleSplitVideo)
+	admin.GET("/users", internal.HandleListUsers)
+	admin.POST("/users", internal.HandleCreateUser)
+	admin.PATCH("/users/:uid", internal.HandleUpdateUser)
+	admin.DELETE("/users/:uid", internal.HandleDeleteUser)
+
+	// Watch party rooms
+	api.POST("/rooms", internal.HandleCreateRoom)
+	api.GET("/rooms/:room", internal.HandleGetRoom)
+	api.GET("/rooms/:room/ws", internal.HandleRoomSocket)
 
 	r.Run(":8066")
 }